@@ -3,111 +3,730 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/options"
 	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/kungze/quic-tun/pkg/tunnel"
 	"github.com/lucas-clemente/quic-go"
 )
 
+// ForwardRule describes a local socket which client endpoint listen on, the
+// connections accepted by the socket are forwarded to server endpoint, and the
+// token of each connection is provided by the rule's token source.
+type ForwardRule struct {
+	// The name of the rule, it will be shown in tunnel records and logs.
+	Name        string
+	LocalSocket string
+	TokenSource token.TokenSourcePlugin
+	// The credentials which the client applications must provide, only used by
+	// the proxy listen modes (socks5, httpproxy). If Username is empty, no authentication.
+	Username string
+	Password string
+}
+
+// scheme return the lower case scheme of the rule's local socket
+func (r *ForwardRule) scheme() string {
+	return strings.ToLower(strings.SplitN(r.LocalSocket, ":", 2)[0])
+}
+
+// frontend return the proxy frontend of the rule, it is nil if the rule
+// isn't in a proxy listen mode.
+func (r *ForwardRule) frontend() proxyFrontend {
+	switch r.scheme() {
+	case "socks5":
+		return socks5Frontend{username: r.Username, password: r.Password}
+	case "httpproxy":
+		return &httpProxyFrontend{username: r.Username, password: r.Password}
+	default:
+		return nil
+	}
+}
+
+// The client applications must finish the negotiation of the proxy protocol within the duration
+const proxyNegotiateTimeout = 10 * time.Second
+
+// proxyFrontend negotiates with the client applications which speak a proxy
+// protocol, the destination requested by the client application becomes the
+// token sent to server endpoint.
+type proxyFrontend interface {
+	// negotiate return the destination requested by the client application, e.g. tcp:example.com:22,
+	// and the connection which should be used by the tunnel, it may be wrapped by the frontend.
+	negotiate(conn net.Conn) (net.Conn, string, error)
+	// reply tells the client application the result of the handshake, the ack is
+	// received from server endpoint, it is zero if no ack was received.
+	reply(conn net.Conn, ack byte) error
+}
+
 type ClientEndpoint struct {
-	LocalSocket          string
+	// All forward rules share the same QUIC session with server endpoint
+	ForwardRules         []ForwardRule
 	ServerEndpointSocket string
-	TokenSource          token.TokenSourcePlugin
 	TlsConfig            *tls.Config
+	// The server endpoints which the new tunnels fail over between, if it is
+	// empty, ServerEndpointSocket is the only server endpoint.
+	ServerEndpoints []ServerTarget
+	// The strategy to choose the server endpoint for the new tunnels, empty means
+	// ServerStrategyActivePassive.
+	ServerStrategy string
+	// The server endpoints are probed over the QUIC session periodically to measure
+	// the RTT and check their health, zero means they aren't probed.
+	ProbeInterval time.Duration
+	// A probe fails if server endpoint doesn't respond within the duration
+	ProbeTimeout time.Duration
+	// The reverse forward rules are registered with server endpoint over the QUIC session
+	ReverseForwardRules []ReverseForwardRule
+	// The interval before the first re-dial attempt once the session with
+	// server endpoint is broken, the interval doubles after each failed attempt.
+	ReconnectInitialInterval time.Duration
+	// The upper limit of the re-dial interval
+	ReconnectMaxInterval time.Duration
+	// Give up re-dialing after the number of failed attempts, zero means retry forever.
+	ReconnectMaxRetries int
+	// The max time to wait for the active tunnels to finish after the context
+	// passed to Run is canceled.
+	DrainTimeout time.Duration
+	// The UDP flow is closed after it is idle for the duration
+	UDPIdleTimeout time.Duration
+	// The callbacks of the tunnels' lifecycle events
+	Hooks tunnel.Hooks
+	// Called when the state of the session with server endpoint changed
+	OnSessionStateChanged func(SessionStatus)
+	// If it isn't nil, the tokens are signed before they are sent to server endpoint
+	TokenSigner *token.TokenSigner
+	// If it isn't nil, the tokens are encrypted before they are sent to server endpoint
+	TokenEncryptor *token.TokenEncryptor
+	// The length of the tokens in the v1 handshake, it must be same as server endpoint's.
+	// Zero means constants.TokenLength.
+	TokenLength int
+	// The version of the handshake protocol, zero means tunnel.HandshakeLatest.
+	// The v1 handshake is used to connect the server endpoints before v2.
+	HandshakeVersion int
+	// The config of the QUIC transport, nil means the defaults of quic-go with
+	// keep-alive. The datagrams are always enabled for the UDP tunnels.
+	QuicConfig *quic.Config
+	// The buffer sizes of the UDP socket, zero means the system default.
+	UDPReadBuffer  int
+	UDPWriteBuffer int
+	// The number of the QUIC sessions with server endpoint, the new tunnels are
+	// spread over them according to PoolStrategy. Zero means a single session.
+	PoolSize int
+	// The strategy to assign the new tunnels to the sessions, PoolStrategyLeastStreams
+	// or PoolStrategyForwardRule, empty means PoolStrategyLeastStreams.
+	PoolStrategy string
+
+	setupOnce    sync.Once
+	servers      *serverGroup
+	mu           sync.Mutex
+	listeners    []net.Listener
+	packetConns  []net.PacketConn
+	draining     bool
+	maintenance  int32
+	serving      sync.WaitGroup
+	tunnels      sync.WaitGroup
+	shutdownOnce sync.Once
+	// The registration status of the reverse forward rules, the key is rule's name
+	registrations map[string]*RegistrationStatus
+	// Closed once the endpoint starts to shut down
+	shuttingDown chan struct{}
+	// Closed after the endpoint was shut down
+	stopped chan struct{}
 }
 
-func (c *ClientEndpoint) Start() {
-	// Dial server endpoint
-	session, err := quic.DialAddr(c.ServerEndpointSocket, c.TlsConfig, &quic.Config{KeepAlive: true})
-	if err != nil {
-		panic(err)
+func (c *ClientEndpoint) setup() {
+	c.setupOnce.Do(func() {
+		c.servers = newServerGroup(c)
+		c.shuttingDown = make(chan struct{})
+		c.registrations = map[string]*RegistrationStatus{}
+		c.stopped = make(chan struct{})
+	})
+}
+
+func (c *ClientEndpoint) tokenLength() int {
+	if c.TokenLength > 0 {
+		return c.TokenLength
 	}
-	parent_ctx := context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String())
-	// Listen on a TCP or UNIX socket, wait client application's connection request.
-	localSocket := strings.Split(c.LocalSocket, ":")
-	listener, err := net.Listen(strings.ToLower(localSocket[0]), strings.Join(localSocket[1:], ":"))
-	if err != nil {
-		panic(err)
+	return constants.TokenLength
+}
+
+func (c *ClientEndpoint) handshakeVersion() int {
+	if c.HandshakeVersion > 0 {
+		return c.HandshakeVersion
+	}
+	return tunnel.HandshakeLatest
+}
+
+func (c *ClientEndpoint) quicConfig() *quic.Config {
+	config := &quic.Config{KeepAlive: true}
+	if c.QuicConfig != nil {
+		config = c.QuicConfig.Clone()
+	}
+	config.EnableDatagrams = true
+	return config
+}
+
+// tokenSource wraps the token source according to the endpoint's settings, e.g. signs or encrypts the tokens.
+func (c *ClientEndpoint) tokenSource(source token.TokenSourcePlugin) token.TokenSourcePlugin {
+	if c.TokenSigner != nil {
+		source = token.NewSignedTokenSourcePlugin(source, c.TokenSigner)
+	}
+	if c.TokenEncryptor != nil {
+		source = token.NewEncryptedTokenSourcePlugin(source, c.TokenEncryptor)
+	}
+	return source
+}
+
+// SessionStatus return the status of the QUIC session between client endpoint and server endpoint.
+// If there are multiple sessions, the first connected one with the preferred server endpoint is returned.
+func (c *ClientEndpoint) SessionStatus() SessionStatus {
+	c.setup()
+	return c.servers.Status()
+}
+
+// SessionPoolStatus return the status and stream statistics of the QUIC sessions with all server endpoints.
+func (c *ClientEndpoint) SessionPoolStatus() []PoolSessionStatus {
+	c.setup()
+	return c.servers.SessionStatuses()
+}
+
+// ServerEndpointStatus return the health of all server endpoints.
+func (c *ClientEndpoint) ServerEndpointStatus() []ServerEndpointStatus {
+	c.setup()
+	return c.servers.ServerStatuses()
+}
+
+// InMaintenance reports whether the endpoint is in maintenance mode.
+func (c *ClientEndpoint) InMaintenance() bool {
+	return atomic.LoadInt32(&c.maintenance) == 1
+}
+
+// SetMaintenance turns on/off maintenance mode. In maintenance mode, the endpoint
+// refuses new client application connections, but the active tunnels are not affected.
+func (c *ClientEndpoint) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.maintenance, v)
+	log.Infow("Client endpoint maintenance mode changed", "maintenance", enabled)
+}
+
+// newTokenSource loads the token source plugin from the registry with its
+// config section.
+func newTokenSource(co *options.ClientOptions, plugin string, source string) (token.TokenSourcePlugin, error) {
+	return token.NewTokenSourcePluginWithConfig(plugin, source, co.GetTokenPluginConfig(plugin))
+}
+
+// NewClientEndpoint validates the options and creates a client endpoint, the
+// token source plugin of each forward rule is loaded according to the options.
+func NewClientEndpoint(co *options.ClientOptions, tlsConfig *tls.Config) (*ClientEndpoint, error) {
+	if err := co.Validate(); err != nil {
+		return nil, err
+	}
+	var forwardRules []ForwardRule
+	for _, f := range co.GetForwards() {
+		tokenSource, err := newTokenSource(co, f.TokenPlugin, f.TokenSource)
+		if err != nil {
+			return nil, fmt.Errorf("the forward rule %s is invalid: %w", f.Name, err)
+		}
+		forwardRules = append(forwardRules, ForwardRule{
+			Name:        f.Name,
+			LocalSocket: f.ListenOn,
+			TokenSource: tokenSource,
+			Username:    f.ProxyUsername,
+			Password:    f.ProxyPassword,
+		})
+	}
+	var tokenSigner *token.TokenSigner
+	if co.TokenSigningKey != "" {
+		tokenSigner = token.NewTokenSigner(co.TokenSigningKey, co.TokenTTL)
+	}
+	var tokenEncryptor *token.TokenEncryptor
+	if co.TokenEncryptionKey != "" {
+		var err error
+		if tokenEncryptor, err = token.NewTokenEncryptor(co.TokenEncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	var serverEndpoints []ServerTarget
+	for _, e := range co.GetServerEndpoints() {
+		serverEndpoints = append(serverEndpoints, ServerTarget{Address: e.Address, Priority: e.Priority, Weight: e.Weight})
 	}
-	defer listener.Close()
-	log.Infow("Client endpoint start up successful", "listen address", listener.Addr())
+	var reverseForwardRules []ReverseForwardRule
+	for _, f := range co.GetReverseForwards() {
+		tokenSource, err := newTokenSource(co, f.TokenPlugin, f.TokenSource)
+		if err != nil {
+			return nil, fmt.Errorf("the reverse forward rule %s is invalid: %w", f.Name, err)
+		}
+		reverseForwardRules = append(reverseForwardRules, ReverseForwardRule{
+			Name:        f.Name,
+			ConnectTo:   f.ConnectTo,
+			TokenSource: tokenSource,
+		})
+	}
+	return &ClientEndpoint{
+		ForwardRules:             forwardRules,
+		ReverseForwardRules:      reverseForwardRules,
+		ServerEndpointSocket:     co.ServerEndpointSocket,
+		ServerEndpoints:          serverEndpoints,
+		ServerStrategy:           co.ServerStrategy,
+		ProbeInterval:            co.ProbeInterval,
+		ProbeTimeout:             co.ProbeTimeout,
+		TlsConfig:                tlsConfig,
+		ReconnectInitialInterval: co.ReconnectInitialInterval,
+		ReconnectMaxInterval:     co.ReconnectMaxInterval,
+		ReconnectMaxRetries:      co.ReconnectMaxRetries,
+		DrainTimeout:             co.DrainTimeout,
+		UDPIdleTimeout:           co.UDPIdleTimeout,
+		TokenSigner:              tokenSigner,
+		TokenEncryptor:           tokenEncryptor,
+		TokenLength:              co.TokenLength,
+		HandshakeVersion:         co.HandshakeVersion,
+		QuicConfig:               tunnel.NewQuicConfig(&co.Transport),
+		UDPReadBuffer:            co.Transport.UDPReadBuffer,
+		UDPWriteBuffer:           co.Transport.UDPWriteBuffer,
+		PoolSize:                 co.PoolSize,
+		PoolStrategy:             co.PoolStrategy,
+	}, nil
+}
+
+// Run listens on the sockets of all forward rules and forwards the accepted
+// connections to server endpoint. It blocks until the endpoint is shut down,
+// once ctx is canceled, the endpoint is shut down with DrainTimeout. If any
+// socket cannot be listened on, it returns the error immediately.
+func (c *ClientEndpoint) Run(ctx context.Context) error {
+	c.setup()
+	if len(c.ForwardRules) == 0 && len(c.ReverseForwardRules) == 0 {
+		return errors.New("no forward rule is specified")
+	}
+	var (
+		listeners   []net.Listener
+		packetConns []net.PacketConn
+		// The listeners and packet conns, and the forward rule of each of them
+		sockets     []io.Closer
+		socketRules []*ForwardRule
+	)
+	closeAll := func() {
+		for _, s := range sockets {
+			s.Close()
+		}
+	}
+	for i := range c.ForwardRules {
+		rule := &c.ForwardRules[i]
+		localSocket := strings.Split(rule.LocalSocket, ":")
+		network := rule.scheme()
+		if network == "socks5" || network == "httpproxy" {
+			// The proxy listen modes listen on a TCP socket
+			network = "tcp"
+		}
+		addresses := []string{strings.Join(localSocket[1:], ":")}
+		if network != "unix" {
+			var err error
+			if addresses, err = expandPortRange(addresses[0]); err != nil {
+				closeAll()
+				return fmt.Errorf("the forward rule %s is invalid: %w", rule.Name, err)
+			}
+		}
+		for _, address := range addresses {
+			var socket io.Closer
+			if network == "udp" {
+				// Listen on a UDP socket, the datagrams are forwarded as QUIC datagrams.
+				pconn, err := net.ListenPacket(network, address)
+				if err != nil {
+					closeAll()
+					return fmt.Errorf("failed to listen on %s: %w", address, err)
+				}
+				packetConns = append(packetConns, pconn)
+				socket = pconn
+			} else {
+				// Listen on a TCP or UNIX socket, wait client application's connection request.
+				listener, err := net.Listen(network, address)
+				if err != nil {
+					closeAll()
+					return fmt.Errorf("failed to listen on %s: %w", address, err)
+				}
+				listeners = append(listeners, listener)
+				socket = listener
+			}
+			sockets = append(sockets, socket)
+			socketRules = append(socketRules, rule)
+		}
+	}
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		closeAll()
+		return errors.New("client endpoint is already shut down")
+	}
+	c.listeners = listeners
+	c.packetConns = packetConns
+	c.serving.Add(len(sockets))
+	c.mu.Unlock()
+	// Dial server endpoints, and re-dial them once the sessions are broken.
+	c.servers.Run()
+	if len(c.ReverseForwardRules) > 0 {
+		go c.serveReverse()
+	}
+	for i, socket := range sockets {
+		rule := socketRules[i]
+		switch socket := socket.(type) {
+		case net.Listener:
+			log.Infow("Client endpoint start up successful", constants.ForwardRule, rule.Name, "listen address", socket.Addr())
+			go func() {
+				defer c.serving.Done()
+				c.serve(rule, socket)
+			}()
+		case net.PacketConn:
+			log.Infow("Client endpoint start up successful", constants.ForwardRule, rule.Name, "listen address", socket.LocalAddr())
+			go func() {
+				defer c.serving.Done()
+				c.serveUDP(rule, socket)
+			}()
+		}
+	}
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.DrainTimeout)
+		defer cancel()
+		_ = c.Shutdown(shutdownCtx)
+	case <-c.stopped:
+	}
+	return nil
+}
+
+// expandPortRange expands the address whose port is a range like 6500-6599 to
+// the addresses of each port in the range.
+func expandPortRange(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !strings.Contains(port, "-") {
+		return []string{address}, nil
+	}
+	low, high, _ := strings.Cut(port, "-")
+	l, err1 := strconv.Atoi(low)
+	h, err2 := strconv.Atoi(high)
+	if err1 != nil || err2 != nil || l <= 0 || h > 65535 || l > h {
+		return nil, fmt.Errorf("the port range %s is invalid", port)
+	}
+	addresses := make([]string, 0, h-l+1)
+	for p := l; p <= h; p++ {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addresses, nil
+}
+
+// Shutdown stops accepting new client application connections and waits for
+// the active tunnels to finish. If ctx is done before that, the QUIC session
+// is closed which breaks all remaining tunnels, and the ctx's error is returned.
+func (c *ClientEndpoint) Shutdown(ctx context.Context) error {
+	c.setup()
+	var err error
+	c.shutdownOnce.Do(func() {
+		log.Info("Client endpoint is shutting down, stop accepting new connections.")
+		c.mu.Lock()
+		c.draining = true
+		close(c.shuttingDown)
+		for _, listener := range c.listeners {
+			listener.Close()
+		}
+		for _, pconn := range c.packetConns {
+			pconn.Close()
+		}
+		c.mu.Unlock()
+		c.serving.Wait()
+
+		drained := make(chan struct{})
+		go func() {
+			c.tunnels.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			log.Info("All tunnels are finished.")
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Warnw("Timeout to wait the tunnels to finish, close them forcibly.", "error", err.Error())
+		}
+		c.servers.Close()
+		<-drained
+		close(c.stopped)
+	})
+	<-c.stopped
+	return err
+}
+
+// serve accept the client application connections of the forward rule
+func (c *ClientEndpoint) serve(rule *ForwardRule, listener net.Listener) {
 	for {
 		// Accept client application connectin request
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorw("Client app connect failed", "error", err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorw("Client app connect failed", constants.ForwardRule, rule.Name, "error", err.Error())
 		} else {
-			logger := log.WithValues(constants.ClientAppAddr, conn.RemoteAddr().String())
+			logger := log.WithValues(constants.ForwardRule, rule.Name, constants.ClientAppAddr, conn.RemoteAddr().String())
+			if c.InMaintenance() {
+				logger.Warn("Client endpoint is in maintenance mode, refuse the connection.")
+				conn.Close()
+				continue
+			}
 			logger.Info("Client connection accepted, prepare to entablish tunnel with server endpint for this connection.")
+			c.tunnels.Add(1)
 			go func() {
-				defer func() {
-					conn.Close()
-					logger.Info("Tunnel closed")
-				}()
-				// Open a quic stream for each client application connection.
-				stream, err := session.OpenStreamSync(context.Background())
-				if err != nil {
-					logger.Errorw("Failed to open stream to server endpoint.", "error", err.Error())
-					return
-				}
-				defer stream.Close()
-				logger = logger.WithValues(constants.StreamID, stream.StreamID())
-				// Create a context argument for each new tunnel
-				ctx := context.WithValue(
-					logger.WithContext(parent_ctx),
-					constants.CtxClientAppAddr, conn.RemoteAddr().String())
-				hsh := tunnel.NewHandshakeHelper(constants.TokenLength, handshake)
-				hsh.TokenSource = &c.TokenSource
-				// Create a new tunnel for the new client application connection.
-				tun := tunnel.NewTunnel(&stream, constants.ClientEndpoint)
-				tun.Conn = &conn
-				tun.Hsh = &hsh
-				if !tun.HandShake(ctx) {
-					return
-				}
-				tun.Establish(ctx)
+				defer c.tunnels.Done()
+				c.handleConn(logger, rule, conn)
 			}()
 		}
 	}
 }
 
+func (c *ClientEndpoint) handleConn(logger log.Logger, rule *ForwardRule, conn net.Conn) {
+	defer func() {
+		conn.Close()
+		logger.Info("Tunnel closed")
+	}()
+	tokenSource := c.tokenSource(rule.TokenSource)
+	frontend := rule.frontend()
+	if frontend != nil {
+		// The destination requested by the client application is used as token
+		_ = conn.SetDeadline(time.Now().Add(proxyNegotiateTimeout))
+		proxyConn, dest, err := frontend.negotiate(conn)
+		_ = conn.SetDeadline(time.Time{})
+		if err != nil {
+			logger.Errorw("Failed to negotiate with client app.", "scheme", rule.scheme(), "error", err.Error())
+			return
+		}
+		conn = proxyConn
+		logger = logger.WithValues("destination", dest)
+		tokenSource = c.tokenSource(token.NewFixedTokenPlugin(dest))
+	}
+	lease, err := c.servers.acquire(context.Background(), rule.Name)
+	if err != nil {
+		logger.Errorw("No available session with server endpoint.", "error", err.Error())
+		if frontend != nil {
+			_ = frontend.reply(conn, 0)
+		}
+		return
+	}
+	defer lease.release()
+	parent_ctx := context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, lease.session.RemoteAddr().String())
+	// Open a quic stream for each client application connection.
+	stream, err := lease.openStream()
+	if err != nil {
+		logger.Errorw("Failed to open stream to server endpoint.", "error", err.Error())
+		if frontend != nil {
+			_ = frontend.reply(conn, 0)
+		}
+		return
+	}
+	defer stream.Close()
+	logger = logger.WithValues(constants.StreamID, stream.StreamID())
+	// Create a context argument for each new tunnel
+	ctx := context.WithValue(
+		logger.WithContext(parent_ctx),
+		constants.CtxClientAppAddr, conn.RemoteAddr().String())
+	ctx = context.WithValue(ctx, constants.CtxConnContext, newConnContext(rule, conn.RemoteAddr(), conn.LocalAddr(), peerCred(conn)))
+	hsh := tunnel.NewHandshakeHelper(c.tokenLength(), handshake)
+	hsh.Version = c.handshakeVersion()
+	hsh.TokenSource = &tokenSource
+	// Create a new tunnel for the new client application connection.
+	tun := tunnel.NewTunnel(&stream, constants.ClientEndpoint)
+	tun.Conn = &conn
+	tun.Hsh = &hsh
+	tun.ForwardRule = rule.Name
+	tun.Hooks = &c.Hooks
+	ok := tun.HandShake(ctx)
+	if frontend != nil {
+		var ack byte
+		if len(hsh.ReceiveData) > 0 {
+			ack = hsh.ReceiveData[0]
+		}
+		if err := frontend.reply(conn, ack); err != nil {
+			logger.Errorw("Failed to reply client app.", "error", err.Error())
+			return
+		}
+	}
+	if !ok {
+		return
+	}
+	tun.Establish(ctx)
+}
+
+// serveUDP receives the datagrams from the UDP socket of the forward rule, the
+// datagrams from the same client application address are treated as a flow,
+// each flow is forwarded by a tunnel.
+func (c *ClientEndpoint) serveUDP(rule *ForwardRule, pconn net.PacketConn) {
+	var mu sync.Mutex
+	flows := map[string]chan []byte{}
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorw("Failed to read datagram from client app", constants.ForwardRule, rule.Name, "error", err.Error())
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		mu.Lock()
+		queue, ok := flows[addr.String()]
+		if !ok {
+			logger := log.WithValues(constants.ForwardRule, rule.Name, constants.ClientAppAddr, addr.String())
+			if c.InMaintenance() {
+				mu.Unlock()
+				logger.Warn("Client endpoint is in maintenance mode, drop the datagram.")
+				continue
+			}
+			logger.Info("New UDP flow received, prepare to entablish tunnel with server endpint for this flow.")
+			queue = make(chan []byte, 128)
+			flows[addr.String()] = queue
+			c.tunnels.Add(1)
+			go func() {
+				defer c.tunnels.Done()
+				c.handleFlow(logger, rule, pconn, addr, queue)
+				mu.Lock()
+				delete(flows, addr.String())
+				mu.Unlock()
+			}()
+		}
+		// Drop the datagram if the flow is too busy, just like UDP does.
+		select {
+		case queue <- data:
+		default:
+		}
+		mu.Unlock()
+	}
+}
+
+func (c *ClientEndpoint) handleFlow(logger log.Logger, rule *ForwardRule, pconn net.PacketConn, addr net.Addr, queue <-chan []byte) {
+	lease, err := c.servers.acquire(context.Background(), rule.Name)
+	if err != nil {
+		logger.Errorw("No available session with server endpoint.", "error", err.Error())
+		return
+	}
+	defer lease.release()
+	session := lease.session
+	if !session.ConnectionState().SupportsDatagrams {
+		logger.Error("The server endpoint doesn't support QUIC datagram, can't forward UDP traffic.")
+		return
+	}
+	parent_ctx := context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String())
+	// Open a quic stream for each UDP flow, the stream is used to handshake
+	// and its ID identifies the flow's datagrams.
+	stream, err := lease.openStream()
+	if err != nil {
+		logger.Errorw("Failed to open stream to server endpoint.", "error", err.Error())
+		return
+	}
+	defer stream.Close()
+	logger = logger.WithValues(constants.StreamID, stream.StreamID())
+	ctx := context.WithValue(
+		logger.WithContext(parent_ctx),
+		constants.CtxClientAppAddr, addr.String())
+	ctx = context.WithValue(ctx, constants.CtxConnContext, newConnContext(rule, addr, pconn.LocalAddr(), nil))
+	hsh := tunnel.NewHandshakeHelper(c.tokenLength(), handshake)
+	hsh.Version = c.handshakeVersion()
+	hsh.Capabilities = tunnel.CapabilityDatagram
+	tokenSource := c.tokenSource(rule.TokenSource)
+	hsh.TokenSource = &tokenSource
+	tun := tunnel.NewTunnel(&stream, constants.ClientEndpoint)
+	tun.Hsh = &hsh
+	tun.ForwardRule = rule.Name
+	tun.ClientAppAddr = addr.String()
+	tun.Hooks = &c.Hooks
+	if !tun.HandShake(ctx) {
+		return
+	}
+	appSend := func(data []byte) error {
+		_, err := pconn.WriteTo(data, addr)
+		return err
+	}
+	tun.EstablishDatagram(ctx, session, queue, appSend, c.UDPIdleTimeout)
+}
+
+// newConnContext return the connection context passed to the token source plugins
+func newConnContext(rule *ForwardRule, remoteAddr net.Addr, localAddr net.Addr, cred *token.PeerCred) *token.ConnContext {
+	connCtx := &token.ConnContext{
+		SourceAddr:  remoteAddr.String(),
+		ListenAddr:  localAddr.String(),
+		ForwardRule: rule.Name,
+		PeerCred:    cred,
+	}
+	if _, port, err := net.SplitHostPort(connCtx.ListenAddr); err == nil {
+		connCtx.ListenPort, _ = strconv.Atoi(port)
+	}
+	return connCtx
+}
+
 func handshake(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
 	logger := log.FromContext(ctx)
 	logger.Info("Starting handshake with server endpoint")
-	token, err := (*hsh.TokenSource).GetToken(fmt.Sprint(ctx.Value(constants.CtxClientAppAddr)))
+	connCtx, ok := ctx.Value(constants.CtxConnContext).(*token.ConnContext)
+	if !ok {
+		connCtx = &token.ConnContext{SourceAddr: fmt.Sprint(ctx.Value(constants.CtxClientAppAddr))}
+	}
+	tok, err := token.GetToken(*hsh.TokenSource, connCtx)
 	if err != nil {
 		logger.Errorw("Encounter error.", "erros", err.Error())
 		return false, nil
 	}
-	hsh.SetSendData([]byte(token))
-	_, err = io.CopyN(*stream, hsh, constants.TokenLength)
-	if err != nil {
-		logger.Errorw("Failed to send token", err.Error())
+	hsh.Metadata = map[string]string{
+		tunnel.MetadataClientAppAddr: connCtx.SourceAddr,
+		tunnel.MetadataForwardRule:   connCtx.ForwardRule,
+	}
+	// The token mustn't be truncated, otherwise server endpoint can't parse it.
+	if err = hsh.SendToken(*stream, tok); err != nil {
+		logger.Errorw("Failed to send token", "error", err.Error())
 		return false, nil
 	}
-	_, err = io.CopyN(hsh, *stream, constants.AckMsgLength)
+	ack, err := hsh.ReceiveAck(*stream)
 	if err != nil {
-		logger.Errorw("Failed to receive ack", err.Error())
+		logger.Errorw("Failed to receive ack", "error", err.Error())
 		return false, nil
 	}
-	switch hsh.ReceiveData[0] {
-	case constants.HandshakeSuccess:
-		logger.Info("Handshake successful")
+	if ack == constants.HandshakeSuccess {
+		logger.Infow("Handshake successful", "version", hsh.Version, "capabilities", hsh.Capabilities)
 		return true, nil
+	}
+	if hsh.Message != "" {
+		logger.Errorw("handshake error!", "error", ackError(ack), "message", hsh.Message)
+	} else {
+		logger.Errorw("handshake error!", "error", ackError(ack))
+	}
+	return false, nil
+}
+
+// ackError describes the failure ack of server endpoint.
+func ackError(ack byte) string {
+	switch ack {
 	case constants.ParseTokenError:
-		logger.Errorw("handshake error!", "error", "server endpoint can not parser token")
-		return false, nil
+		return "server endpoint can not parse token"
 	case constants.CannotConnServer:
-		logger.Errorw("handshake error!", "error", "server endpoint can not connect to server application")
-		return false, nil
+		return "server endpoint can not connect to server application"
+	case constants.EndpointDraining:
+		return "server endpoint is in maintenance mode or shutting down"
+	case constants.RegistrationRefused:
+		return "server endpoint refuses the registration"
+	case constants.DeniedByPolicy:
+		return "the server application is denied by server endpoint's access control policy"
+	case constants.UnsupportedHandshake:
+		return "server endpoint doesn't support the handshake version"
+	case constants.BackendUnhealthy:
+		return "all backends of the server application are unhealthy"
 	default:
-		logger.Errorw("handshake error!", "error", "received an unknow ack info")
-		return false, nil
+		return "received an unknow ack info"
 	}
 }
@@ -1,22 +1,22 @@
 /*
 Copyright © 2022 NAME HERE <EMAIL ADDRESS>
-
 */
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
-	"fmt"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
 	"github.com/kungze/quic-tun/client"
+	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
 	"github.com/kungze/quic-tun/pkg/options"
 	"github.com/kungze/quic-tun/pkg/restfulapi"
-	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -26,6 +26,7 @@ var (
 	apiOptions    *options.RestfulAPIOptions
 	secOptions    *options.SecureOptions
 	logOptions    *log.Options
+	listPlugins   bool
 )
 
 func buildCommand(basename string) *cobra.Command {
@@ -46,18 +47,26 @@ Find more quic-tun information at:
 	secOptions.AddFlags(rootCmd.Flags())
 	options.AddConfigFlag(basename, rootCmd.Flags())
 	logOptions.AddFlags(rootCmd.Flags())
+	rootCmd.Flags().BoolVar(&listPlugins, "list-plugins", false,
+		"List the token plugins and discriminators compiled in the binary, then exit.")
 
 	return rootCmd
 }
 
 func runCommand(cmd *cobra.Command, args []string) error {
+	if listPlugins {
+		options.PrintPlugins(constants.ClientEndpoint)
+		return nil
+	}
 	options.PrintWorkingDir()
 	options.PrintFlags(cmd.Flags())
-	options.PrintConfig()
 
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
 		return err
 	}
+	// The config is printed after the flags are bound, so that it shows the
+	// values taking effect, no matter they come from flags, env or config file.
+	options.PrintConfig()
 
 	if err := viper.Unmarshal(clientOptions); err != nil {
 		return err
@@ -76,18 +85,13 @@ func runCommand(cmd *cobra.Command, args []string) error {
 	}
 
 	// run server
-	runFunc(clientOptions, apiOptions, secOptions)
-	return nil
+	return runFunc(clientOptions, apiOptions, secOptions)
 }
 
-func runFunc(co *options.ClientOptions, ao *options.RestfulAPIOptions, seco *options.SecureOptions) {
+func runFunc(co *options.ClientOptions, ao *options.RestfulAPIOptions, seco *options.SecureOptions) error {
 	log.Init(logOptions)
 	defer log.Flush()
 
-	localSocket := co.ListenOn
-	serverEndpointSocket := co.ServerEndpointSocket
-	tokenPlugin := co.TokenPlugin
-	tokenSource := co.TokenSource
 	certFile := seco.CertFile
 	keyFile := seco.KeyFile
 	caFile := seco.CaFile
@@ -102,7 +106,7 @@ func runFunc(co *options.ClientOptions, ao *options.RestfulAPIOptions, seco *opt
 		tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			log.Errorw("Certificate file or private key file is invalid.", "error", err.Error())
-			return
+			return err
 		}
 		tlsConfig.Certificates = []tls.Certificate{tlsCert}
 	}
@@ -110,6 +114,7 @@ func runFunc(co *options.ClientOptions, ao *options.RestfulAPIOptions, seco *opt
 		caPemBlock, err := os.ReadFile(caFile)
 		if err != nil {
 			log.Errorw("Failed to read ca file.", "error", err.Error())
+			return err
 		}
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(caPemBlock)
@@ -118,36 +123,41 @@ func runFunc(co *options.ClientOptions, ao *options.RestfulAPIOptions, seco *opt
 		certPool, err := x509.SystemCertPool()
 		if err != nil {
 			log.Errorw("Failed to load system cert pool", "error", err.Error())
-			return
+			return err
 		}
 		tlsConfig.ClientCAs = certPool
 	}
 
+	c, err := client.NewClientEndpoint(co, tlsConfig)
+	if err != nil {
+		log.Errorw("Failed to create client endpoint.", "error", err.Error())
+		return err
+	}
+
+	// The API server and client endpoint are shut down gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start API server
 	httpd := restfulapi.NewHttpd(apiListenOn)
-	go httpd.Start()
+	httpd.Token = ao.HttpdToken
+	httpd.AddGetter("/session", func() any { return c.SessionStatus() })
+	httpd.AddGetter("/sessions", func() any { return c.SessionPoolStatus() })
+	httpd.AddGetter("/servers", func() any { return c.ServerEndpointStatus() })
+	httpd.AddGetter("/registrations", func() any { return c.Registrations() })
+	httpd.SetMaintainer(c)
+	go func() {
+		if err := httpd.Run(ctx); err != nil {
+			log.Errorw("API server exited.", "error", err.Error())
+		}
+	}()
 
 	// Start client endpoint
-	c := client.ClientEndpoint{
-		LocalSocket:          localSocket,
-		ServerEndpointSocket: serverEndpointSocket,
-		TokenSource:          loadTokenSourcePlugin(tokenPlugin, tokenSource),
-		TlsConfig:            tlsConfig,
-	}
-	c.Start()
-}
-
-func loadTokenSourcePlugin(plugin string, source string) token.TokenSourcePlugin {
-	switch strings.ToLower(plugin) {
-	case "fixed":
-		return token.NewFixedTokenPlugin(source)
-	case "file":
-		return token.NewFileTokenSourcePlugin(source)
-	case "http":
-		return token.NewHttpTokenPlugin(source)
-	default:
-		panic(fmt.Sprintf("The token source plugin %s is invalid", plugin))
+	if err := c.Run(ctx); err != nil {
+		log.Errorw("Client endpoint exited.", "error", err.Error())
+		return err
 	}
+	return nil
 }
 
 func main() {
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+)
+
+// httpProxyFrontend negotiates with the client applications which speak HTTP
+// proxy protocol. Both CONNECT request and plain HTTP request with absolute-URI
+// are supported. If the username is not empty, the client applications must
+// provide the Proxy-Authorization header with basic scheme.
+type httpProxyFrontend struct {
+	username string
+	password string
+	// Whether the request is a CONNECT request, it is set by negotiate.
+	connect bool
+}
+
+func (h *httpProxyFrontend) negotiate(conn net.Conn) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if !h.authorized(req) {
+		_ = writeHTTPResponse(conn, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="quic-tun"`}})
+		return nil, "", errors.New("HTTP proxy authorization failed")
+	}
+	if req.Method == http.MethodConnect {
+		h.connect = true
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			_ = writeHTTPResponse(conn, http.StatusBadRequest, nil)
+			return nil, "", fmt.Errorf("the authority of CONNECT request is invalid: %w", err)
+		}
+		// The data after the CONNECT request may have been buffered by the reader
+		return &prefixedConn{Conn: conn, reader: reader}, "tcp:" + req.Host, nil
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		_ = writeHTTPResponse(conn, http.StatusBadRequest, nil)
+		return nil, "", fmt.Errorf("the URI %s of HTTP proxy request isn't absolute http URI", req.RequestURI)
+	}
+	authority := req.URL.Host
+	if _, _, err := net.SplitHostPort(authority); err != nil {
+		authority = net.JoinHostPort(strings.Trim(authority, "[]"), "80")
+	}
+	// The request is forwarded to server application in origin-form, and the
+	// connection is closed after the response, because the next request of the
+	// client application may be for another server application.
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Set("Connection", "close")
+	var buf bytes.Buffer
+	if err := writeRequestHeader(&buf, req); err != nil {
+		return nil, "", err
+	}
+	// The body isn't read by ReadRequest, it is still in the reader with its
+	// original framing, so it is streamed after the negotiation deadline is cleared.
+	return &prefixedConn{Conn: conn, reader: io.MultiReader(&buf, reader)}, "tcp:" + authority, nil
+}
+
+// writeRequestHeader writes the request line in origin-form and the headers of
+// the request. ReadRequest moves the Host and Transfer-Encoding headers out of
+// req.Header, so they are written back, the Content-Length header is kept.
+func writeRequestHeader(w io.Writer, req *http.Request) error {
+	if _, err := fmt.Fprintf(w, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor, req.Host); err != nil {
+		return err
+	}
+	if len(req.TransferEncoding) > 0 {
+		if _, err := fmt.Fprintf(w, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", ")); err != nil {
+			return err
+		}
+	}
+	if err := req.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+func (h *httpProxyFrontend) authorized(req *http.Request) bool {
+	if h.username == "" {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	username, password, _ := strings.Cut(string(credentials), ":")
+	return subtle.ConstantTimeCompare([]byte(username), []byte(h.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) == 1
+}
+
+// reply maps the ack of server endpoint to the HTTP response status, the plain
+// HTTP request needn't a response on success, the server application responds it.
+func (h *httpProxyFrontend) reply(conn net.Conn, ack byte) error {
+	switch ack {
+	case constants.HandshakeSuccess:
+		if h.connect {
+			return writeHTTPResponse(conn, http.StatusOK, nil)
+		}
+		return nil
+	case constants.ParseTokenError, constants.DeniedByPolicy:
+		return writeHTTPResponse(conn, http.StatusForbidden, nil)
+	case constants.BackendUnhealthy:
+		return writeHTTPResponse(conn, http.StatusServiceUnavailable, nil)
+	default:
+		return writeHTTPResponse(conn, http.StatusBadGateway, nil)
+	}
+}
+
+func writeHTTPResponse(conn net.Conn, status int, header http.Header) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	_ = header.Write(&buf)
+	// The tunnel begins after the successful response of CONNECT request
+	if status != http.StatusOK {
+		buf.WriteString("Connection: close\r\nContent-Length: 0\r\n")
+	}
+	buf.WriteString("\r\n")
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// prefixedConn is a net.Conn whose Read returns the data of reader, the
+// reader contains the data which was read from the Conn in advance.
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package client
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/kungze/quic-tun/pkg/token"
+)
+
+// peerCred returns the credentials of the UNIX socket peer by SO_PEERCRED, it
+// is nil if the connection isn't a UNIX socket.
+func peerCred(conn net.Conn) *token.PeerCred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return nil
+	}
+	return &token.PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package client
+
+import (
+	"net"
+
+	"github.com/kungze/quic-tun/pkg/token"
+)
+
+// peerCred isn't supported on the platform, it always returns nil.
+func peerCred(conn net.Conn) *token.PeerCred {
+	return nil
+}
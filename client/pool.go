@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The strategies to assign the new tunnels to the sessions of the pool
+const (
+	// The tunnel is assigned to the healthy session with the least active streams.
+	PoolStrategyLeastStreams = "least-streams"
+	// The tunnels of a forward rule are assigned to the same session, so that the
+	// bulk transfer of a rule doesn't share the flow control and congestion windows
+	// with the other rules. If the session isn't healthy, it falls back to least-streams.
+	PoolStrategyForwardRule = "forward-rule"
+)
+
+// A connected session is unhealthy after the number of consecutive failures to
+// open stream, the new tunnels avoid it until a stream is opened successfully.
+const maxConsecutiveStreamFailures = 3
+
+// PoolSessionStatus describes a session of the pool and the streams over it.
+type PoolSessionStatus struct {
+	SessionStatus
+	Healthy bool `json:"healthy"`
+	// The number of the tunnels over the session now
+	ActiveStreams int64 `json:"activeStreams"`
+	// The number of the tunnels assigned to the session since client endpoint started
+	TotalStreams int64 `json:"totalStreams"`
+	// The number of the streams which failed to open over the session
+	FailedStreams int64 `json:"failedStreams"`
+}
+
+// poolMember is a session of the pool and its stream statistics.
+type poolMember struct {
+	manager             *sessionManager
+	activeStreams       int64
+	totalStreams        int64
+	failedStreams       int64
+	consecutiveFailures int64
+}
+
+func (m *poolMember) healthy(status SessionStatus) bool {
+	return status.State == SessionConnected && atomic.LoadInt64(&m.consecutiveFailures) < maxConsecutiveStreamFailures
+}
+
+// sessionPool keeps multiple QUIC sessions with a server endpoint, each session
+// is supervised by a session manager, the new tunnels are spread over them.
+type sessionPool struct {
+	members  []*poolMember
+	strategy string
+}
+
+// newSessionPool creates the pool of the server endpoint, notify is called every
+// time the state of any session changed.
+func newSessionPool(c *ClientEndpoint, serverAddr, serverName string, notify func()) *sessionPool {
+	size := c.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	p := &sessionPool{strategy: c.PoolStrategy}
+	for i := 0; i < size; i++ {
+		m := &poolMember{}
+		m.manager = newSessionManager(c, serverAddr, serverName, i, func(status SessionStatus) {
+			// The failures of the broken session don't affect the new one
+			if status.State == SessionConnected {
+				atomic.StoreInt64(&m.consecutiveFailures, 0)
+			}
+			notify()
+			if c.OnSessionStateChanged != nil {
+				c.OnSessionStateChanged(status)
+			}
+		})
+		p.members = append(p.members, m)
+	}
+	return p
+}
+
+// Run dials server endpoint for every session of the pool.
+func (p *sessionPool) Run() {
+	for _, m := range p.members {
+		go m.manager.Run()
+	}
+}
+
+// Close closes all sessions of the pool.
+func (p *sessionPool) Close() {
+	for _, m := range p.members {
+		m.manager.Close()
+	}
+}
+
+// primary return the manager of the first session, the reverse forward rules are
+// registered over it.
+func (p *sessionPool) primary() *sessionManager {
+	return p.members[0].manager
+}
+
+// connectedSession return the first connected session, it is nil if no session is connected.
+func (p *sessionPool) connectedSession() quic.Session {
+	for _, m := range p.members {
+		if session, status := m.manager.current(); status.State == SessionConnected {
+			return session
+		}
+	}
+	return nil
+}
+
+// Statuses return the status and stream statistics of all sessions of the pool.
+func (p *sessionPool) Statuses() []PoolSessionStatus {
+	statuses := make([]PoolSessionStatus, 0, len(p.members))
+	for _, m := range p.members {
+		status := m.manager.Status()
+		statuses = append(statuses, PoolSessionStatus{
+			SessionStatus: status,
+			Healthy:       m.healthy(status),
+			ActiveStreams: atomic.LoadInt64(&m.activeStreams),
+			TotalStreams:  atomic.LoadInt64(&m.totalStreams),
+			FailedStreams: atomic.LoadInt64(&m.failedStreams),
+		})
+	}
+	return statuses
+}
+
+// countStates return the number of the sessions in each state.
+func (p *sessionPool) countStates() map[string]int {
+	states := map[string]int{}
+	for _, m := range p.members {
+		states[m.manager.Status().State]++
+	}
+	return states
+}
+
+// pick chooses a connected session according to the strategy, the healthy
+// sessions are preferred. It returns nil if no session is connected.
+func (p *sessionPool) pick(rule string) *lease {
+	type candidate struct {
+		member  *poolMember
+		session quic.Session
+		healthy bool
+	}
+	candidates := make([]candidate, len(p.members))
+	for i, m := range p.members {
+		session, status := m.manager.current()
+		if status.State == SessionConnected {
+			candidates[i] = candidate{member: m, session: session, healthy: m.healthy(status)}
+		}
+	}
+	if p.strategy == PoolStrategyForwardRule {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(rule))
+		if c := candidates[int(h.Sum32()%uint32(len(candidates)))]; c.healthy {
+			return newLease(c.member, c.session)
+		}
+	}
+	var best *candidate
+	for i := range candidates {
+		c := &candidates[i]
+		if c.member == nil {
+			continue
+		}
+		if best == nil || (c.healthy && !best.healthy) ||
+			(c.healthy == best.healthy && atomic.LoadInt64(&c.member.activeStreams) < atomic.LoadInt64(&best.member.activeStreams)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return newLease(best.member, best.session)
+}
+
+// lease is a session assigned to a tunnel.
+type lease struct {
+	session quic.Session
+	member  *poolMember
+}
+
+func newLease(m *poolMember, session quic.Session) *lease {
+	atomic.AddInt64(&m.activeStreams, 1)
+	atomic.AddInt64(&m.totalStreams, 1)
+	return &lease{session: session, member: m}
+}
+
+// openStream opens the stream of the tunnel over the session, the failures
+// are recorded to track the session's health.
+func (l *lease) openStream() (quic.Stream, error) {
+	stream, err := l.session.OpenStreamSync(context.Background())
+	if err != nil {
+		atomic.AddInt64(&l.member.failedStreams, 1)
+		atomic.AddInt64(&l.member.consecutiveFailures, 1)
+		return nil, err
+	}
+	atomic.StoreInt64(&l.member.consecutiveFailures, 0)
+	return stream, nil
+}
+
+// release returns the session once the tunnel is closed.
+func (l *lease) release() {
+	atomic.AddInt64(&l.member.activeStreams, -1)
+}
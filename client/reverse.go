@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/token"
+	"github.com/kungze/quic-tun/pkg/tunnel"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ReverseForwardRule describes an application which client endpoint can connect.
+// The rule is registered with server endpoint, server endpoint listens on the
+// socket parsed from the token, and forwards the accepted connections back to
+// client endpoint, then client endpoint connects the application.
+type ReverseForwardRule struct {
+	// The name of the rule, it will be shown in tunnel records and logs.
+	Name        string
+	ConnectTo   string
+	TokenSource token.TokenSourcePlugin
+}
+
+// The states of a reverse forward rule's registration
+const (
+	// The rule is registered with server endpoint
+	RegistrationRegistered = "registered"
+	// The rule isn't registered yet, or the registration is broken and client endpoint is re-registering it.
+	RegistrationRegistering = "registering"
+)
+
+// RegistrationStatus describes the registration of a reverse forward rule.
+type RegistrationStatus struct {
+	Name         string `json:"name"`
+	ConnectTo    string `json:"connectTo"`
+	State        string `json:"state"`
+	RegisteredAt string `json:"registeredAt,omitempty"`
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// Registrations return the registration status of the reverse forward rules.
+func (c *ClientEndpoint) Registrations() []RegistrationStatus {
+	c.setup()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	registrations := make([]RegistrationStatus, 0, len(c.ReverseForwardRules))
+	for _, rule := range c.ReverseForwardRules {
+		if status, ok := c.registrations[rule.Name]; ok {
+			registrations = append(registrations, *status)
+		} else {
+			registrations = append(registrations, RegistrationStatus{
+				Name:      rule.Name,
+				ConnectTo: rule.ConnectTo,
+				State:     RegistrationRegistering,
+			})
+		}
+	}
+	return registrations
+}
+
+func (c *ClientEndpoint) setRegistration(rule *ReverseForwardRule, update func(*RegistrationStatus)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.registrations[rule.Name]
+	if !ok {
+		status = &RegistrationStatus{Name: rule.Name, ConnectTo: rule.ConnectTo}
+		c.registrations[rule.Name] = status
+	}
+	update(status)
+}
+
+// serveReverse registers the reverse forward rules with server endpoint and
+// accepts the streams opened by server endpoint. Once the session is broken,
+// the rules are registered again over the new session. The rules are registered
+// over the first session of the preferred server endpoint.
+func (c *ClientEndpoint) serveReverse() {
+	var session quic.Session
+	for {
+		var err error
+		session, err = c.servers.reverseSession(context.Background(), session)
+		if err != nil {
+			return
+		}
+		c.serveReverseSession(session)
+	}
+}
+
+func (c *ClientEndpoint) serveReverseSession(session quic.Session) {
+	logger := log.WithValues(constants.RemoteEndpointAddr, session.RemoteAddr().String())
+	// The key is the ID of the registration stream, the value is the rule
+	var registered sync.Map
+	for i := range c.ReverseForwardRules {
+		rule := &c.ReverseForwardRules[i]
+		go c.keepRegistered(logger.WithValues(constants.ForwardRule, rule.Name), session, rule, &registered)
+	}
+	for {
+		// Server endpoint opens a stream for each connection it accepted.
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		logger := logger.WithValues(constants.StreamID, stream.StreamID())
+		// The tunnels are counted under the lock, so that no tunnel is counted after shutdown start to wait them.
+		c.mu.Lock()
+		if c.draining || c.InMaintenance() {
+			c.mu.Unlock()
+			logger.Warn("Client endpoint is in maintenance mode or shutting down, refuse the reverse tunnel.")
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		c.tunnels.Add(1)
+		c.mu.Unlock()
+		go func() {
+			defer c.tunnels.Done()
+			c.handleReverseStream(logger, session, stream, &registered)
+		}()
+	}
+}
+
+// keepRegistered registers the rule over the session, and re-registers it once
+// the registration is broken, until the session is broken or the endpoint is
+// shutting down.
+func (c *ClientEndpoint) keepRegistered(logger log.Logger, session quic.Session, rule *ReverseForwardRule, registered *sync.Map) {
+	interval := c.ReconnectInitialInterval
+	for {
+		stream, err := c.register(session, rule, registered)
+		if err == nil {
+			logger.Info("Reverse forward rule registered")
+			interval = c.ReconnectInitialInterval
+			c.setRegistration(rule, func(s *RegistrationStatus) {
+				s.State = RegistrationRegistered
+				s.RegisteredAt = time.Now().String()
+				s.LastError = ""
+			})
+			// The registration stream is kept open during the registration's lifetime,
+			// it is closed by client endpoint once the endpoint is shutting down.
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-c.shuttingDown:
+					stream.CancelRead(0)
+					stream.Close()
+				case <-closed:
+				}
+			}()
+			_, _ = io.Copy(io.Discard, stream)
+			close(closed)
+			registered.Delete(stream.StreamID())
+			err = errors.New("the registration is closed")
+		}
+		c.setRegistration(rule, func(s *RegistrationStatus) {
+			s.State = RegistrationRegistering
+			s.LastError = err.Error()
+		})
+		select {
+		case <-session.Context().Done():
+			return
+		case <-c.shuttingDown:
+			return
+		default:
+		}
+		logger.Warnw("Failed to register reverse forward rule, will retry later.", "interval", interval.String(), "error", err.Error())
+		select {
+		case <-time.After(interval):
+		case <-session.Context().Done():
+			return
+		case <-c.shuttingDown:
+			return
+		}
+		if interval *= 2; interval > c.ReconnectMaxInterval {
+			interval = c.ReconnectMaxInterval
+		}
+	}
+}
+
+// register sends the rule's token with the reverse prefix to server endpoint,
+// if the registration is accepted, the registration stream is returned.
+func (c *ClientEndpoint) register(session quic.Session, rule *ReverseForwardRule, registered *sync.Map) (quic.Stream, error) {
+	// The socket which the server endpoint listens on is decided by the token,
+	// the client application's address is meaningless, so ConnectTo is used.
+	tok, err := token.GetToken(c.tokenSource(rule.TokenSource), &token.ConnContext{SourceAddr: rule.ConnectTo, ForwardRule: rule.Name})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	// Server endpoint may open reverse streams as soon as it sent the ack,
+	// so the rule is stored before the registration.
+	registered.Store(stream.StreamID(), rule)
+	fail := func(err error) (quic.Stream, error) {
+		registered.Delete(stream.StreamID())
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+	hsh := tunnel.NewHandshakeHelper(c.tokenLength(), nil)
+	hsh.Version = c.handshakeVersion()
+	hsh.Capabilities = tunnel.CapabilityReverse
+	hsh.Metadata = map[string]string{tunnel.MetadataForwardRule: rule.Name}
+	if err = hsh.SendToken(stream, constants.ReverseTokenPrefix+tok); err != nil {
+		return fail(err)
+	}
+	ack, err := hsh.ReceiveAck(stream)
+	if err != nil {
+		return fail(err)
+	}
+	if ack == constants.HandshakeSuccess {
+		return stream, nil
+	}
+	if hsh.Message != "" {
+		return fail(fmt.Errorf("%s: %s", ackError(ack), hsh.Message))
+	}
+	return fail(errors.New(ackError(ack)))
+}
+
+func (c *ClientEndpoint) handleReverseStream(logger log.Logger, session quic.Session, stream quic.Stream, registered *sync.Map) {
+	defer stream.Close()
+	ctx := logger.WithContext(context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String()))
+	var rule *ReverseForwardRule
+	hsh := tunnel.NewHandshakeHelper(constants.AckMsgLength, func(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
+		var conn *net.Conn
+		rule, conn = reverseHandshake(ctx, stream, hsh, registered)
+		return conn != nil, conn
+	})
+	tun := tunnel.NewTunnel(&stream, constants.ClientEndpoint)
+	tun.Hsh = &hsh
+	tun.Reverse = true
+	tun.Hooks = &c.Hooks
+	if !tun.HandShake(ctx) {
+		return
+	}
+	tun.ForwardRule = rule.Name
+	ctx = log.FromContext(ctx).WithValues(constants.ForwardRule, rule.Name, constants.ServerAppAddr, (*tun.Conn).RemoteAddr().String()).WithContext(ctx)
+	tun.Establish(ctx)
+}
+
+// reverseHandshake receives the registration ID from server endpoint, and connects
+// the application of the registered rule. The ID is framed like a token in the
+// handshake version of the registration, the ack is sent in the same version.
+func reverseHandshake(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper, registered *sync.Map) (*ReverseForwardRule, *net.Conn) {
+	logger := log.FromContext(ctx)
+	logger.Info("Starting reverse handshake with server endpoint")
+	if err := hsh.ReceiveToken(*stream, constants.TokenLength); err != nil {
+		logger.Errorw("Can not receive registration ID", "error", err.Error())
+		return nil, nil
+	}
+	var rule *ReverseForwardRule
+	if id, err := strconv.ParseInt(hsh.ReceiveData, 10, 64); err == nil {
+		if r, ok := registered.Load(quic.StreamID(id)); ok {
+			rule = r.(*ReverseForwardRule)
+		}
+	}
+	if rule == nil {
+		logger.Errorw("The registration is unknown", "registration", hsh.ReceiveData)
+		_ = hsh.SendAck(*stream, constants.CannotConnServer, "the registration "+hsh.ReceiveData+" is unknown")
+		return nil, nil
+	}
+	logger = logger.WithValues(constants.ForwardRule, rule.Name, constants.ServerAppAddr, rule.ConnectTo)
+	logger.Info("starting connect to server app")
+	sockets := strings.Split(rule.ConnectTo, ":")
+	conn, err := net.Dial(strings.ToLower(sockets[0]), strings.Join(sockets[1:], ":"))
+	if err != nil {
+		logger.Errorw("Failed to dial server app", "error", err.Error())
+		_ = hsh.SendAck(*stream, constants.CannotConnServer, err.Error())
+		return nil, nil
+	}
+	logger.Info("Server app connect successful")
+	if err = hsh.SendAck(*stream, constants.HandshakeSuccess, ""); err != nil {
+		logger.Errorw("Faied to send ack info", "error", err.Error())
+		conn.Close()
+		return nil, nil
+	}
+	logger.Info("Handshake successful")
+	return rule, &conn
+}
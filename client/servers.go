@@ -0,0 +1,451 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/tunnel"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The strategies to choose the server endpoint for the new tunnels, they choose
+// among the healthy server endpoints with the lowest priority value.
+const (
+	// The first server endpoint in the configured order is used.
+	ServerStrategyActivePassive = "active-passive"
+	// The server endpoints are used in turn according to their weights.
+	ServerStrategyRoundRobin = "round-robin"
+	// The server endpoint with the lowest RTT measured by the probes is used.
+	ServerStrategyLowestRTT = "lowest-rtt"
+)
+
+// A server endpoint is unhealthy after the number of consecutive failed probes.
+const maxProbeFailures = 2
+
+// The timeout to resolve the hostnames of the server endpoints
+const resolveTimeout = 5 * time.Second
+
+// ServerTarget is a server endpoint which client endpoint can connect.
+type ServerTarget struct {
+	// The address like example.com:7500, if the hostname resolves to several
+	// addresses, each of them is a server endpoint with the same priority and weight.
+	Address string
+	// The server endpoints with the lower priority value are preferred, the others
+	// are only used if all of them are unhealthy.
+	Priority int
+	// The weight in the round-robin strategy, zero means 1.
+	Weight int
+}
+
+// ServerEndpointStatus describes a server endpoint and its health.
+type ServerEndpointStatus struct {
+	Address string `json:"address"`
+	// The configured hostname if the address is one of the addresses it resolves to
+	ServerName string `json:"serverName,omitempty"`
+	Priority   int    `json:"priority"`
+	Weight     int    `json:"weight"`
+	Healthy    bool   `json:"healthy"`
+	// The RTT measured by the last successful probe
+	RTT            string `json:"rtt,omitempty"`
+	LastProbeAt    string `json:"lastProbeAt,omitempty"`
+	LastProbeError string `json:"lastProbeError,omitempty"`
+	// The number of the connected sessions and the tunnels over them
+	ConnectedSessions int   `json:"connectedSessions"`
+	ActiveStreams     int64 `json:"activeStreams"`
+}
+
+// serverMember is a server endpoint of the group, its sessions and health.
+type serverMember struct {
+	target     ServerTarget
+	addr       string
+	serverName string
+	pool       *sessionPool
+
+	mu             sync.Mutex
+	rtt            time.Duration
+	probeFailures  int
+	lastProbeAt    time.Time
+	lastProbeError string
+	// The current weight of the smooth weighted round-robin, it is protected by the group's mu
+	currentWeight int
+}
+
+// healthy reports whether the server endpoint has a connected session, and its
+// probes don't fail.
+func (m *serverMember) healthy() bool {
+	if m.pool.connectedSession() == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.probeFailures < maxProbeFailures
+}
+
+// measuredRTT return the RTT measured by the last successful probe, it is
+// math.MaxInt64 if the RTT isn't measured yet.
+func (m *serverMember) measuredRTT() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rtt == 0 {
+		return math.MaxInt64
+	}
+	return m.rtt
+}
+
+// serverGroup keeps the sessions with all server endpoints, the new tunnels
+// fail over to the other server endpoints if the preferred one is unhealthy.
+type serverGroup struct {
+	members       []*serverMember
+	strategy      string
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+	// The probes use the v2 handshake, they are disabled if it is false.
+	probe bool
+
+	mu sync.Mutex
+	// Closed and replaced every time the state of any session or server endpoint changed
+	changed   chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newServerGroup(c *ClientEndpoint) *serverGroup {
+	g := &serverGroup{
+		strategy:      c.ServerStrategy,
+		probeInterval: c.ProbeInterval,
+		probeTimeout:  c.ProbeTimeout,
+		probe:         c.ProbeInterval > 0 && c.handshakeVersion() >= tunnel.HandshakeV2,
+		changed:       make(chan struct{}),
+		closing:       make(chan struct{}),
+	}
+	targets := c.ServerEndpoints
+	if len(targets) == 0 {
+		targets = []ServerTarget{{Address: c.ServerEndpointSocket}}
+	}
+	for _, target := range targets {
+		if target.Weight <= 0 {
+			target.Weight = 1
+		}
+		addrs := resolveServerAddr(target.Address)
+		for _, addr := range addrs {
+			m := &serverMember{target: target, addr: addr, serverName: target.Address}
+			m.pool = newSessionPool(c, addr, target.Address, g.notify)
+			g.members = append(g.members, m)
+		}
+	}
+	return g
+}
+
+// resolveServerAddr return the addresses the hostname of the server endpoint
+// resolves to. If it resolves to a single address or fails to resolve, the
+// address itself is returned, so that it is resolved again on every dial.
+func resolveServerAddr(address string) []string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{address}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil || len(ips) < 2 {
+		return []string{address}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs
+}
+
+func (g *serverGroup) notify() {
+	g.mu.Lock()
+	close(g.changed)
+	g.changed = make(chan struct{})
+	g.mu.Unlock()
+}
+
+func (g *serverGroup) changedChan() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.changed
+}
+
+// Run dials all server endpoints and starts to probe them.
+func (g *serverGroup) Run() {
+	for _, m := range g.members {
+		m.pool.Run()
+		if g.probe {
+			go g.keepProbing(m)
+		}
+	}
+}
+
+// Close stops probing and closes all sessions.
+func (g *serverGroup) Close() {
+	g.closeOnce.Do(func() {
+		close(g.closing)
+	})
+	for _, m := range g.members {
+		m.pool.Close()
+	}
+}
+
+// Status return the status of the first connected session of the preferred
+// server endpoint, if no session is connected, the first session's status is returned.
+func (g *serverGroup) Status() SessionStatus {
+	for _, m := range g.candidates() {
+		for _, status := range m.pool.Statuses() {
+			if status.State == SessionConnected {
+				return status.SessionStatus
+			}
+		}
+	}
+	return g.members[0].pool.primary().Status()
+}
+
+// SessionStatuses return the status and stream statistics of the sessions with all server endpoints.
+func (g *serverGroup) SessionStatuses() []PoolSessionStatus {
+	var statuses []PoolSessionStatus
+	for _, m := range g.members {
+		statuses = append(statuses, m.pool.Statuses()...)
+	}
+	return statuses
+}
+
+// ServerStatuses return the health of all server endpoints.
+func (g *serverGroup) ServerStatuses() []ServerEndpointStatus {
+	statuses := make([]ServerEndpointStatus, 0, len(g.members))
+	for _, m := range g.members {
+		status := ServerEndpointStatus{
+			Address:  m.addr,
+			Priority: m.target.Priority,
+			Weight:   m.target.Weight,
+			Healthy:  m.healthy(),
+		}
+		if m.serverName != m.addr {
+			status.ServerName = m.serverName
+		}
+		for _, s := range m.pool.Statuses() {
+			if s.State == SessionConnected {
+				status.ConnectedSessions++
+			}
+			status.ActiveStreams += s.ActiveStreams
+		}
+		m.mu.Lock()
+		if m.rtt > 0 {
+			status.RTT = m.rtt.String()
+		}
+		if !m.lastProbeAt.IsZero() {
+			status.LastProbeAt = m.lastProbeAt.String()
+		}
+		status.LastProbeError = m.lastProbeError
+		m.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// candidates return the healthy server endpoints with the lowest priority value
+// in the configured order. If no server endpoint is healthy, the ones which have
+// a connected session are returned, because the failed probes may be transient.
+func (g *serverGroup) candidates() []*serverMember {
+	if candidates := lowestPriority(g.members, (*serverMember).healthy); len(candidates) > 0 {
+		return candidates
+	}
+	return lowestPriority(g.members, func(m *serverMember) bool { return m.pool.connectedSession() != nil })
+}
+
+func lowestPriority(members []*serverMember, filter func(*serverMember) bool) []*serverMember {
+	var candidates []*serverMember
+	for _, m := range members {
+		if !filter(m) {
+			continue
+		}
+		if len(candidates) > 0 && m.target.Priority > candidates[0].target.Priority {
+			continue
+		}
+		if len(candidates) > 0 && m.target.Priority < candidates[0].target.Priority {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, m)
+	}
+	return candidates
+}
+
+// choose return the index of the server endpoint to use among the candidates according to the strategy.
+func (g *serverGroup) choose(candidates []*serverMember) int {
+	switch g.strategy {
+	case ServerStrategyRoundRobin:
+		// The smooth weighted round-robin, the server endpoints with the same
+		// weight are used in turn, and a heavier one isn't used in a row.
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		best, total := 0, 0
+		for i, m := range candidates {
+			m.currentWeight += m.target.Weight
+			total += m.target.Weight
+			if m.currentWeight > candidates[best].currentWeight {
+				best = i
+			}
+		}
+		candidates[best].currentWeight -= total
+		return best
+	case ServerStrategyLowestRTT:
+		best := 0
+		for i, m := range candidates {
+			if m.measuredRTT() < candidates[best].measuredRTT() {
+				best = i
+			}
+		}
+		return best
+	default:
+		return 0
+	}
+}
+
+// acquire assigns a session to a new tunnel of the forward rule, if no session
+// is connected, it blocks until a session is established or ctx is done. The
+// returned lease must be released once the tunnel is closed.
+func (g *serverGroup) acquire(ctx context.Context, rule string) (*lease, error) {
+	for {
+		changed := g.changedChan()
+		candidates := g.candidates()
+		for len(candidates) > 0 {
+			i := g.choose(candidates)
+			if l := candidates[i].pool.pick(rule); l != nil {
+				return l, nil
+			}
+			candidates = append(candidates[:i:i], candidates[i+1:]...)
+		}
+		if err := g.unavailable(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reverseSession return the first session of the preferred server endpoint, the
+// reverse forward rules are registered over it. If no such session is connected,
+// it blocks until a session is established or ctx is done. The prev session is
+// never returned again.
+func (g *serverGroup) reverseSession(ctx context.Context, prev quic.Session) (quic.Session, error) {
+	for {
+		changed := g.changedChan()
+		for _, m := range g.candidates() {
+			if session, status := m.pool.primary().current(); status.State == SessionConnected && session != prev {
+				return session, nil
+			}
+		}
+		if err := g.unavailable(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unavailable return the error if no session will be established any more,
+// i.e. client endpoint is shut down or it gave up dialing all server endpoints.
+func (g *serverGroup) unavailable() error {
+	failed, total := 0, 0
+	for _, m := range g.members {
+		states := m.pool.countStates()
+		if states[SessionClosed] > 0 {
+			return errSessionClosed
+		}
+		failed += states[SessionFailed]
+		total += len(m.pool.members)
+	}
+	if failed == total {
+		return errSessionFailed
+	}
+	return nil
+}
+
+// keepProbing probes the server endpoint over its first connected session
+// periodically, until the group is closed.
+func (g *serverGroup) keepProbing(m *serverMember) {
+	logger := log.WithValues(constants.ServerEndpointAddr, m.addr)
+	ticker := time.NewTicker(g.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.closing:
+			return
+		}
+		session := m.pool.connectedSession()
+		if session == nil {
+			continue
+		}
+		rtt, err := g.probeSession(session)
+		m.mu.Lock()
+		wasHealthy := m.probeFailures < maxProbeFailures
+		m.lastProbeAt = time.Now()
+		if err != nil {
+			m.probeFailures++
+			m.lastProbeError = err.Error()
+		} else {
+			m.probeFailures = 0
+			m.lastProbeError = ""
+			m.rtt = rtt
+		}
+		isHealthy := m.probeFailures < maxProbeFailures
+		m.mu.Unlock()
+		if wasHealthy == isHealthy {
+			continue
+		}
+		if isHealthy {
+			logger.Infow("The server endpoint becomes healthy", "rtt", rtt.String())
+		} else {
+			logger.Warnw("The server endpoint becomes unhealthy, the new tunnels fail over to the other server endpoints.", "error", err.Error())
+		}
+		g.notify()
+	}
+}
+
+// probeSession sends a probe handshake over the session and return the RTT.
+// The server endpoints which don't support the probe ack it with a failure
+// other than EndpointDraining, they are considered healthy because they respond.
+func (g *serverGroup) probeSession(session quic.Session) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.probeTimeout)
+	defer cancel()
+	start := time.Now()
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		stream.CancelRead(0)
+		stream.Close()
+	}()
+	_ = stream.SetDeadline(start.Add(g.probeTimeout))
+	hsh := tunnel.NewHandshakeHelper(0, nil)
+	hsh.Version = tunnel.HandshakeV2
+	hsh.Capabilities = tunnel.CapabilityProbe
+	if err = hsh.SendToken(stream, ""); err != nil {
+		return 0, err
+	}
+	ack, err := hsh.ReceiveAck(stream)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	if ack == constants.EndpointDraining {
+		return rtt, errors.New(ackError(ack))
+	}
+	return rtt, nil
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/tunnel"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The all possible states of the QUIC session between client endpoint and server endpoint
+const (
+	// The session is established, new tunnels can be opened over it.
+	SessionConnected = "connected"
+	// The session is broken (or haven't been established), client endpoint is re-dialing server endpoint.
+	SessionReconnecting = "reconnecting"
+	// Client endpoint gave up re-dialing server endpoint after the max retries.
+	SessionFailed = "failed"
+	// The session was closed because client endpoint is shut down.
+	SessionClosed = "closed"
+)
+
+var (
+	errSessionFailed = errors.New("give up to dial server endpoint")
+	errSessionClosed = errors.New("client endpoint is shut down")
+)
+
+// SessionStatus describes the QUIC session between client endpoint and server endpoint.
+type SessionStatus struct {
+	// The index of the session in the session pool
+	Index              int    `json:"index"`
+	State              string `json:"state"`
+	ServerEndpointAddr string `json:"serverEndpointAddr"`
+	RemoteEndpointAddr string `json:"remoteEndpointAddr,omitempty"`
+	ConnectedAt        string `json:"connectedAt,omitempty"`
+	// The number of the failed dial attempts since the last time the session was established
+	Retries   int    `json:"retries"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// sessionManager supervises the QUIC session, once the session is broken
+// it re-dials server endpoint with exponential backoff and jitter.
+type sessionManager struct {
+	serverAddr string
+	// The server name used to verify server endpoint's certificate, it is the
+	// hostname if serverAddr is one of the addresses the hostname resolves to.
+	serverName      string
+	tlsConfig       *tls.Config
+	quicConfig      *quic.Config
+	readBuffer      int
+	writeBuffer     int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	// Zero means retry forever
+	maxRetries int
+	// Called every time the state changed, it wakes up the tunnels which are waiting for the session.
+	onChanged func(SessionStatus)
+
+	// Only used by Run, so it needn't be protected by mu
+	rand *rand.Rand
+
+	mu        sync.RWMutex
+	session   quic.Session
+	status    SessionStatus
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newSessionManager(c *ClientEndpoint, serverAddr, serverName string, index int, onChanged func(SessionStatus)) *sessionManager {
+	return &sessionManager{
+		serverAddr:      serverAddr,
+		serverName:      serverName,
+		tlsConfig:       c.TlsConfig,
+		quicConfig:      c.quicConfig(),
+		readBuffer:      c.UDPReadBuffer,
+		writeBuffer:     c.UDPWriteBuffer,
+		initialInterval: c.ReconnectInitialInterval,
+		maxInterval:     c.ReconnectMaxInterval,
+		maxRetries:      c.ReconnectMaxRetries,
+		onChanged:       onChanged,
+		status:          SessionStatus{Index: index, State: SessionReconnecting, ServerEndpointAddr: serverAddr},
+		closing:         make(chan struct{}),
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano() + int64(index))),
+	}
+}
+
+// Status return a snapshot of the session's status
+func (m *sessionManager) Status() SessionStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// current return the current session and its status, the session is nil if
+// it isn't connected.
+func (m *sessionManager) current() (quic.Session, SessionStatus) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.session, m.status
+}
+
+func (m *sessionManager) setStatus(session quic.Session, update func(*SessionStatus)) {
+	m.mu.Lock()
+	m.session = session
+	update(&m.status)
+	status := m.status
+	m.mu.Unlock()
+	if m.onChanged != nil {
+		m.onChanged(status)
+	}
+}
+
+// Close stops re-dialing and closes the current session, all tunnels over the session are broken.
+func (m *sessionManager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closing)
+	})
+}
+
+// Run dials server endpoint and keeps the session alive, it only returns when
+// the max retries is exceeded or the manager is closed.
+func (m *sessionManager) Run() {
+	logger := log.WithValues(constants.ServerEndpointAddr, m.serverAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.closing
+		cancel()
+	}()
+	retries := 0
+	for {
+		session, err := m.dial(ctx)
+		if ctx.Err() != nil {
+			if session != nil {
+				_ = session.CloseWithError(0, "client endpoint is shut down")
+			}
+			m.setStatus(nil, func(s *SessionStatus) { s.State = SessionClosed })
+			return
+		}
+		if err != nil {
+			retries++
+			if m.maxRetries > 0 && retries > m.maxRetries {
+				logger.Errorw("Failed to dial server endpoint, give up.", "retries", retries-1, "error", err.Error())
+				m.setStatus(nil, func(s *SessionStatus) {
+					s.State = SessionFailed
+					s.LastError = err.Error()
+				})
+				return
+			}
+			interval := m.backoff(retries)
+			logger.Warnw("Failed to dial server endpoint, will retry later.", "retries", retries, "interval", interval.String(), "error", err.Error())
+			m.setStatus(nil, func(s *SessionStatus) {
+				s.State = SessionReconnecting
+				s.Retries = retries
+				s.LastError = err.Error()
+			})
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		retries = 0
+		m.setStatus(session, func(s *SessionStatus) {
+			s.State = SessionConnected
+			s.RemoteEndpointAddr = session.RemoteAddr().String()
+			s.ConnectedAt = time.Now().String()
+			s.Retries = 0
+			s.LastError = ""
+		})
+		logger.Infow("The session with server endpoint is established", constants.RemoteEndpointAddr, session.RemoteAddr().String())
+		// Wait until the session is broken
+		select {
+		case <-session.Context().Done():
+		case <-ctx.Done():
+			_ = session.CloseWithError(0, "client endpoint is shut down")
+			m.setStatus(nil, func(s *SessionStatus) { s.State = SessionClosed })
+			logger.Info("The session with server endpoint is closed")
+			return
+		}
+		logger.Warn("The session with server endpoint is broken, start to reconnect.")
+		m.setStatus(nil, func(s *SessionStatus) {
+			s.State = SessionReconnecting
+			s.LastError = "session closed"
+		})
+	}
+}
+
+// dial dials server endpoint over a new UDP socket, the socket is closed once
+// the session is broken, because quic-go doesn't close the socket it didn't create.
+func (m *sessionManager) dial(ctx context.Context) (quic.Session, error) {
+	remoteAddr, err := net.ResolveUDPAddr("udp", m.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.DialContext(ctx, conn, remoteAddr, m.serverName, m.tlsConfig, m.quicConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = tunnel.SetSocketBuffers(conn, m.readBuffer, m.writeBuffer); err != nil {
+		_ = session.CloseWithError(0, err.Error())
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		<-session.Context().Done()
+		conn.Close()
+	}()
+	return session, nil
+}
+
+// backoff return the interval before the next dial attempt, the interval grows
+// exponentially with the retries, and a random jitter is added to avoid that
+// lots of client endpoints re-dial server endpoint at the same time.
+func (m *sessionManager) backoff(retries int) time.Duration {
+	interval := m.initialInterval
+	for i := 1; i < retries && interval < m.maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > m.maxInterval {
+		interval = m.maxInterval
+	}
+	// Plus or minus 20% jitter
+	jitter := time.Duration(m.rand.Int63n(int64(interval)/5*2+1)) - interval/5
+	return interval + jitter
+}
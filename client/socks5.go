@@ -0,0 +1,181 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+)
+
+// The SOCKS5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded        = 0x00
+	socks5RepGeneralFailure   = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepHostUnreachable  = 0x04
+	socks5RepConnRefused      = 0x05
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+)
+
+// socks5Frontend negotiates with the client applications which speak SOCKS5,
+// only CONNECT command is supported. If the username is not empty, the client
+// applications must authenticate with the username and password.
+type socks5Frontend struct {
+	username string
+	password string
+}
+
+func (s socks5Frontend) negotiate(conn net.Conn) (net.Conn, string, error) {
+	// The greeting: VER, NMETHODS, METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, "", err
+	}
+	if header[0] != socks5Version {
+		return nil, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, "", err
+	}
+	method := byte(socks5MethodNoAuth)
+	if s.username != "" {
+		method = socks5MethodUserPass
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return nil, "", errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, "", err
+	}
+	if method == socks5MethodUserPass {
+		if err := s.authenticate(conn); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// The request: VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, "", err
+	}
+	if request[0] != socks5Version {
+		return nil, "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socks5CmdConnect {
+		_ = s.writeReply(conn, socks5RepCmdNotSupported)
+		return nil, "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, "", err
+		}
+		host = string(domain)
+	default:
+		_ = s.writeReply(conn, socks5RepAtypNotSupported)
+		return nil, "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, "", err
+	}
+	return conn, "tcp:" + net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// authenticate processes the username/password authentication, see RFC 1929
+func (s socks5Frontend) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported SOCKS username/password authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(username, []byte(s.username)) != 1 ||
+		subtle.ConstantTimeCompare(password, []byte(s.password)) != 1 {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return errors.New("SOCKS username or password is incorrect")
+	}
+	_, err := conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess})
+	return err
+}
+
+// reply maps the ack of server endpoint to the SOCKS reply code
+func (s socks5Frontend) reply(conn net.Conn, ack byte) error {
+	switch ack {
+	case constants.HandshakeSuccess:
+		return s.writeReply(conn, socks5RepSucceeded)
+	case constants.ParseTokenError, constants.DeniedByPolicy:
+		return s.writeReply(conn, socks5RepNotAllowed)
+	case constants.CannotConnServer:
+		return s.writeReply(conn, socks5RepConnRefused)
+	case constants.BackendUnhealthy:
+		return s.writeReply(conn, socks5RepHostUnreachable)
+	default:
+		return s.writeReply(conn, socks5RepGeneralFailure)
+	}
+}
+
+func (s socks5Frontend) writeReply(conn net.Conn, rep byte) error {
+	// The bound address is meaningless for the tunnel, so it is always 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -8,8 +8,10 @@ require (
 )
 
 require (
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/google/uuid v1.3.0
 	github.com/lucas-clemente/quic-go v0.26.0
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/spf13/viper v1.12.0
 	go.uber.org/zap v1.17.0
 )
@@ -26,7 +28,6 @@ require (
 
 require (
 	github.com/cheekybits/genny v1.0.0 // indirect
-	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
 	github.com/gosuri/uitable v0.0.4
 	github.com/hashicorp/hcl v1.0.0 // indirect
@@ -35,7 +36,6 @@ require (
 	github.com/marten-seemann/qtls-go1-16 v0.1.5 // indirect
 	github.com/marten-seemann/qtls-go1-17 v0.1.1 // indirect
 	github.com/marten-seemann/qtls-go1-18 v0.1.1 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/nxadm/tail v1.4.8 // indirect
 	github.com/onsi/ginkgo v1.16.4 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
@@ -24,9 +24,3 @@ type DiscriminatorPlugin interface {
 	// related the protocol from the header.
 	GetProperties(ctx context.Context) (properties any)
 }
-
-// TODO(jeffyjf) Now, we just provide a spice discriminator, so we return it directly.
-// If we going to add more discriminators in future, the method should be refactor in advance.
-func LoadDiscriminators() map[string]DiscriminatorPlugin {
-	return map[string]DiscriminatorPlugin{"spice": &spiceDiscriminator{}}
-}
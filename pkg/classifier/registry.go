@@ -0,0 +1,69 @@
+package classifier
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiscriminatorFactory creates the discriminators of a protocol. A discriminator
+// keeps the state of a tunnel, so each tunnel gets new discriminators.
+type DiscriminatorFactory struct {
+	// The description shown by --list-plugins
+	Description string
+	New         func() DiscriminatorPlugin
+}
+
+// DiscriminatorInfo describes a registered discriminator.
+type DiscriminatorInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var (
+	registryMu sync.RWMutex
+	// The keys are the lower case names of the discriminators
+	factories = map[string]DiscriminatorFactory{}
+)
+
+// RegisterDiscriminator makes a discriminator available by the name, the name is
+// case-insensitive and it is the key of the tunnel's protocol properties. It is
+// intended to be called from the init function of the discriminator's package, so
+// that a third-party discriminator is compiled in by a blank import. It panics if
+// the name is already registered.
+func RegisterDiscriminator(name string, factory DiscriminatorFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	name = strings.ToLower(name)
+	if factory.New == nil {
+		panic("classifier: the factory of discriminator " + name + " is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("classifier: the discriminator " + name + " is registered twice")
+	}
+	factories[name] = factory
+}
+
+// Discriminators returns the registered discriminators sorted by name.
+func Discriminators() []DiscriminatorInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	discriminators := make([]DiscriminatorInfo, 0, len(factories))
+	for name, factory := range factories {
+		discriminators = append(discriminators, DiscriminatorInfo{Name: name, Description: factory.Description})
+	}
+	sort.Slice(discriminators, func(i, j int) bool { return discriminators[i].Name < discriminators[j].Name })
+	return discriminators
+}
+
+// LoadDiscriminators creates a new instance of each registered discriminator
+// for a tunnel, the keys are the names of the discriminators.
+func LoadDiscriminators() map[string]DiscriminatorPlugin {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	discriminators := make(map[string]DiscriminatorPlugin, len(factories))
+	for name, factory := range factories {
+		discriminators[name] = factory.New()
+	}
+	return discriminators
+}
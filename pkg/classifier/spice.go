@@ -49,6 +49,13 @@ type spiceProperties struct {
 	ServerUUID  string `json:"serverUUID,omitempty"`
 }
 
+func init() {
+	RegisterDiscriminator("spice", DiscriminatorFactory{
+		Description: "Detect the SPICE protocol and extract the channel type, server name and server UUID.",
+		New:         func() DiscriminatorPlugin { return &spiceDiscriminator{} },
+	})
+}
+
 type spiceDiscriminator struct {
 	properties spiceProperties
 }
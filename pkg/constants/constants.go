@@ -4,10 +4,16 @@ package constants
 type keytype string
 
 const (
-	// The length of token that client endpoint send to server endpoint
+	// The default length of token that client endpoint send to server endpoint in
+	// the v1 handshake, both endpoints must use the same length.
 	TokenLength = 512
-	// The lenght of ack message that server endpoint send to client endpoint
+	// The upper limit of the token length, it is also the limit of the v2 handshake
+	MaxTokenLength = 16384
+	// The lenght of ack message that server endpoint send to client endpoint in the v1 handshake
 	AckMsgLength = 1
+	// The token of a reverse forward rule's registration is prefixed with it,
+	// so that server endpoint can distinguish the registration from a tunnel.
+	ReverseTokenPrefix = "quictun-reverse:"
 )
 
 const (
@@ -17,6 +23,16 @@ const (
 	ParseTokenError = 0x02
 	// Means that server endpoint cannot connect server application
 	CannotConnServer = 0x03
+	// Means that server endpoint is in maintenance mode or shutting down, it refuses new tunnels
+	EndpointDraining = 0x04
+	// Means that server endpoint refuses the reverse forward rule's registration
+	RegistrationRefused = 0x05
+	// Means that the server application is denied by server endpoint's access control policy
+	DeniedByPolicy = 0x06
+	// Means that server endpoint doesn't support the handshake version of client endpoint
+	UnsupportedHandshake = 0x07
+	// Means that all backends of the server application are unhealthy by server endpoint's health checks
+	BackendUnhealthy = 0x08
 )
 
 // The key names of log's additional key/value pairs
@@ -25,12 +41,21 @@ const (
 	StreamID           = "Stream-ID"
 	ServerAppAddr      = "Server-App-Addr"
 	ClientEndpointAddr = "Client-Endpoint-Addr"
+	ServerEndpointAddr = "Server-Endpoint-Addr"
+	RemoteEndpointAddr = "Remote-Endpoint-Addr"
+	ForwardRule        = "Forward-Rule"
+	ReverseListenOn    = "Reverse-Listen-On"
+	Subject            = "Subject"
+	PeerIdentity       = "Peer-Identity"
+	Backend            = "Backend"
 )
 
 // The key names of value context
 const (
 	CtxRemoteEndpointAddr keytype = "Remote-Endpoint-Addr"
 	CtxClientAppAddr      keytype = "Client-App-Addr"
+	// The value is *token.ConnContext, it is passed to the token source plugins
+	CtxConnContext keytype = "Conn-Context"
 )
 
 const (
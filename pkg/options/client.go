@@ -1,33 +1,356 @@
-package options
-
-import "github.com/spf13/pflag"
-
-//ClientOptions contains information for a client service.
-type ClientOptions struct {
-	ListenOn             string `json:"listen-on"           mapstructure:"listen-on"`
-	ServerEndpointSocket string `json:"server-endpoint"     mapstructure:"server-endpoint"`
-	TokenPlugin          string `json:"token-source-plugin" mapstructure:"token-source-plugin"`
-	TokenSource          string `json:"token-source"        mapstructure:"token-source"`
-}
-
-// GetDefaultClientOptions returns a client configuration with default values.
-func GetDefaultClientOptions() *ClientOptions {
-	return &ClientOptions{
-		ListenOn:             "tcp:127.0.0.1:6500",
-		ServerEndpointSocket: "",
-		TokenPlugin:          "Fixed",
-		TokenSource:          "",
-	}
-}
-
-// AddFlags adds flags for a specific Server to the specified FlagSet.
-func (s *ClientOptions) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&s.ListenOn, "listen-on", s.ListenOn,
-		"The socket that the client side endpoint listen on")
-	fs.StringVar(&s.ServerEndpointSocket, "server-endpoint", s.ServerEndpointSocket,
-		"The server side endpoint address, example: example.com:6565")
-	fs.StringVar(&s.TokenPlugin, "token-source-plugin", s.TokenPlugin,
-		"Specify the token plugin. Token used to tell the server endpoint which server app we want to access. Support values: Fixed, File.")
-	fs.StringVar(&s.TokenSource, "token-source", s.TokenSource,
-		"An argument to be passed to the token source plugin on instantiation.")
-}
+package options
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/spf13/pflag"
+)
+
+// ForwardOptions contains information for a forward rule of client endpoint.
+type ForwardOptions struct {
+	Name        string `json:"name"                mapstructure:"name"`
+	ListenOn    string `json:"listen-on"           mapstructure:"listen-on"`
+	TokenPlugin string `json:"token-source-plugin" mapstructure:"token-source-plugin"`
+	TokenSource string `json:"token-source"        mapstructure:"token-source"`
+	// The credentials which the client applications must provide in the proxy listen modes
+	ProxyUsername string `json:"proxy-username"      mapstructure:"proxy-username"`
+	ProxyPassword string `json:"proxy-password"      mapstructure:"proxy-password"`
+}
+
+// ReverseForwardOptions contains information for a reverse forward rule of client
+// endpoint. The token is parsed by server endpoint to get the socket it listen on,
+// the connections accepted by server endpoint are forwarded to ConnectTo.
+type ReverseForwardOptions struct {
+	Name        string `json:"name"                mapstructure:"name"`
+	ConnectTo   string `json:"connect-to"          mapstructure:"connect-to"`
+	TokenPlugin string `json:"token-source-plugin" mapstructure:"token-source-plugin"`
+	TokenSource string `json:"token-source"        mapstructure:"token-source"`
+}
+
+// ServerEndpointOptions contains information for a server endpoint which client
+// endpoint can connect. The server endpoints with the lower priority value are
+// preferred, the weight is used by the round-robin strategy.
+type ServerEndpointOptions struct {
+	Address  string `json:"address"  mapstructure:"address"`
+	Priority int    `json:"priority" mapstructure:"priority"`
+	Weight   int    `json:"weight"   mapstructure:"weight"`
+}
+
+// ClientOptions contains information for a client service.
+type ClientOptions struct {
+	ListenOn             string `json:"listen-on"           mapstructure:"listen-on"`
+	ServerEndpointSocket string `json:"server-endpoint"     mapstructure:"server-endpoint"`
+	TokenPlugin          string `json:"token-source-plugin" mapstructure:"token-source-plugin"`
+	TokenSource          string `json:"token-source"        mapstructure:"token-source"`
+	ProxyUsername        string `json:"proxy-username"      mapstructure:"proxy-username"`
+	ProxyPassword        string `json:"proxy-password"      mapstructure:"proxy-password"`
+	// If the signing key is specified, the tokens are signed, the server endpoint
+	// should use the "Signed" token parser plugin with the same key.
+	TokenSigningKey string        `json:"token-signing-key" mapstructure:"token-signing-key"`
+	TokenTTL        time.Duration `json:"token-ttl"         mapstructure:"token-ttl"`
+	TokenLength     int           `json:"token-length"      mapstructure:"token-length"`
+	// The version of the handshake protocol, 1 is used to connect the old server endpoints
+	HandshakeVersion int `json:"handshake-version" mapstructure:"handshake-version"`
+	// If the encryption key is specified, the tokens are encrypted, the server endpoint
+	// should use the "Encrypted" token parser plugin with the same key.
+	TokenEncryptionKey string `json:"token-encryption-key" mapstructure:"token-encryption-key"`
+	// The options about re-dialing server endpoint when the QUIC session is broken
+	ReconnectInitialInterval time.Duration `json:"reconnect-initial-interval" mapstructure:"reconnect-initial-interval"`
+	ReconnectMaxInterval     time.Duration `json:"reconnect-max-interval"     mapstructure:"reconnect-max-interval"`
+	ReconnectMaxRetries      int           `json:"reconnect-max-retries"      mapstructure:"reconnect-max-retries"`
+	DrainTimeout             time.Duration `json:"drain-timeout"              mapstructure:"drain-timeout"`
+	UDPIdleTimeout           time.Duration `json:"udp-idle-timeout"           mapstructure:"udp-idle-timeout"`
+	// The QUIC sessions with server endpoint, the new tunnels are spread over them
+	PoolSize     int    `json:"pool-size"     mapstructure:"pool-size"`
+	PoolStrategy string `json:"pool-strategy" mapstructure:"pool-strategy"`
+	// The server endpoints with priority and weight can only be specified in config
+	// file, if it is empty, server-endpoint is a comma separated list of addresses.
+	ServerEndpoints []ServerEndpointOptions `json:"server-endpoints" mapstructure:"server-endpoints"`
+	ServerStrategy  string                  `json:"server-strategy"  mapstructure:"server-strategy"`
+	ProbeInterval   time.Duration           `json:"probe-interval"   mapstructure:"probe-interval"`
+	ProbeTimeout    time.Duration           `json:"probe-timeout"    mapstructure:"probe-timeout"`
+	// Multiple forward rules can only be specified in config file, if it is
+	// empty, the listen-on and token-source* options make up a single rule.
+	Forwards []ForwardOptions `json:"forwards" mapstructure:"forwards"`
+	// The reverse forward rules can only be specified in config file
+	ReverseForwards []ReverseForwardOptions `json:"reverse-forwards" mapstructure:"reverse-forwards"`
+	// The options of the Http token source plugin
+	HttpToken HttpTokenOptions `mapstructure:",squash"`
+	// The options of the Exec token source plugin
+	ExecToken ExecTokenOptions `mapstructure:",squash"`
+	// The config sections of the token source plugins, the keys are the plugin names.
+	// They can only be specified in config file.
+	TokenPlugins map[string]map[string]any `json:"token-plugins" mapstructure:"token-plugins"`
+	// The options of the QUIC transport
+	Transport TransportOptions `json:"transport" mapstructure:"transport"`
+}
+
+// GetTokenPluginConfig returns the config section of the token source plugin.
+// The sections of the Http and Exec plugins are filled by their flags first,
+// the keys in the token-plugins section override them.
+func (s *ClientOptions) GetTokenPluginConfig(plugin string) map[string]any {
+	plugin = strings.ToLower(plugin)
+	var config map[string]any
+	switch plugin {
+	case "http":
+		config = s.HttpToken.PluginConfig()
+	case "exec":
+		config = s.ExecToken.PluginConfig()
+	}
+	return mergePluginConfig(config, s.TokenPlugins[plugin])
+}
+
+// GetServerEndpoints returns the server endpoints. If server-endpoints isn't
+// specified, the addresses in server-endpoint have the same priority, so the
+// active-passive strategy fails over between them in the order.
+func (s *ClientOptions) GetServerEndpoints() []ServerEndpointOptions {
+	if len(s.ServerEndpoints) > 0 {
+		endpoints := make([]ServerEndpointOptions, len(s.ServerEndpoints))
+		for i, e := range s.ServerEndpoints {
+			if e.Weight == 0 {
+				e.Weight = 1
+			}
+			endpoints[i] = e
+		}
+		return endpoints
+	}
+	var endpoints []ServerEndpointOptions
+	for _, address := range strings.Split(s.ServerEndpointSocket, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			endpoints = append(endpoints, ServerEndpointOptions{Address: address, Weight: 1})
+		}
+	}
+	return endpoints
+}
+
+// GetForwards returns the forward rules, the rules which don't specify token
+// source plugin inherit the global one. If listen-on is empty, there isn't a
+// default rule, this is useful when the client endpoint only has reverse rules.
+func (s *ClientOptions) GetForwards() []ForwardOptions {
+	if len(s.Forwards) == 0 {
+		if s.ListenOn == "" {
+			return nil
+		}
+		return []ForwardOptions{{
+			Name:          "default",
+			ListenOn:      s.ListenOn,
+			TokenPlugin:   s.TokenPlugin,
+			TokenSource:   s.TokenSource,
+			ProxyUsername: s.ProxyUsername,
+			ProxyPassword: s.ProxyPassword,
+		}}
+	}
+	forwards := make([]ForwardOptions, len(s.Forwards))
+	for i, f := range s.Forwards {
+		if f.Name == "" {
+			f.Name = f.ListenOn
+		}
+		if f.TokenPlugin == "" {
+			f.TokenPlugin = s.TokenPlugin
+		}
+		if f.ProxyUsername == "" {
+			f.ProxyUsername, f.ProxyPassword = s.ProxyUsername, s.ProxyPassword
+		}
+		forwards[i] = f
+	}
+	return forwards
+}
+
+// GetReverseForwards returns the reverse forward rules, the rules which don't
+// specify token source plugin inherit the global one.
+func (s *ClientOptions) GetReverseForwards() []ReverseForwardOptions {
+	reverseForwards := make([]ReverseForwardOptions, len(s.ReverseForwards))
+	for i, f := range s.ReverseForwards {
+		if f.Name == "" {
+			f.Name = f.ConnectTo
+		}
+		if f.TokenPlugin == "" {
+			f.TokenPlugin = s.TokenPlugin
+		}
+		reverseForwards[i] = f
+	}
+	return reverseForwards
+}
+
+// GetDefaultClientOptions returns a client configuration with default values.
+func GetDefaultClientOptions() *ClientOptions {
+	// Client endpoint keeps the session alive, so that the first tunnel after a
+	// long idle period needn't wait for re-dialing.
+	transport := GetDefaultTransportOptions()
+	transport.KeepAlive = true
+	return &ClientOptions{
+		ListenOn:                 "tcp:127.0.0.1:6500",
+		ServerEndpointSocket:     "",
+		TokenPlugin:              "Fixed",
+		TokenSource:              "",
+		ReconnectInitialInterval: time.Second,
+		ReconnectMaxInterval:     time.Minute,
+		ReconnectMaxRetries:      0,
+		DrainTimeout:             30 * time.Second,
+		UDPIdleTimeout:           time.Minute,
+		PoolSize:                 1,
+		PoolStrategy:             "least-streams",
+		ServerStrategy:           "active-passive",
+		ProbeInterval:            10 * time.Second,
+		ProbeTimeout:             3 * time.Second,
+		TokenTTL:                 time.Minute,
+		TokenLength:              constants.TokenLength,
+		HandshakeVersion:         2,
+		HttpToken:                GetDefaultHttpTokenOptions(),
+		ExecToken:                GetDefaultExecTokenOptions(),
+		Transport:                transport,
+	}
+}
+
+// AddFlags adds flags for a specific Server to the specified FlagSet.
+func (s *ClientOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&s.ListenOn, "listen-on", s.ListenOn,
+		"The socket that the client side endpoint listen on, support tcp, unix, udp, socks5 and httpproxy scheme. "+
+			"In socks5 and httpproxy mode, the destination requested by the client application is used as token. "+
+			"The port of tcp and udp can be a range. Example: tcp:127.0.0.1:6500, tcp:127.0.0.1:6500-6599")
+	fs.StringVar(&s.ServerEndpointSocket, "server-endpoint", s.ServerEndpointSocket,
+		"The server side endpoint address, example: example.com:6565. Multiple addresses are separated by comma, "+
+			"the new tunnels fail over between them, a hostname which resolves to several addresses is also expanded.")
+	fs.StringVar(&s.ServerStrategy, "server-strategy", s.ServerStrategy,
+		"The strategy to choose the server endpoint for the new tunnels among the healthy ones with the lowest priority value. "+
+			"Support values: active-passive, round-robin, lowest-rtt.")
+	fs.DurationVar(&s.ProbeInterval, "probe-interval", s.ProbeInterval,
+		"Probe the server endpoints over the QUIC session periodically to measure the RTT and check their health, "+
+			"0 means they aren't probed. The probes require the v2 handshake.")
+	fs.DurationVar(&s.ProbeTimeout, "probe-timeout", s.ProbeTimeout,
+		"A probe fails if the server endpoint doesn't respond within the duration.")
+	fs.StringVar(&s.TokenPlugin, "token-source-plugin", s.TokenPlugin,
+		"Specify the token plugin. Token used to tell the server endpoint which server app we want to access. Support values: Fixed, File, Http, Template, Exec, or the third-party plugins listed by --list-plugins.")
+	fs.StringVar(&s.TokenSource, "token-source", s.TokenSource,
+		"An argument to be passed to the token source plugin on instantiation.")
+	fs.StringVar(&s.ProxyUsername, "proxy-username", s.ProxyUsername,
+		"The username which the client applications must provide in the socks5 and httpproxy listen mode, empty means no authentication.")
+	fs.StringVar(&s.ProxyPassword, "proxy-password", s.ProxyPassword,
+		"The password which the client applications must provide in the socks5 and httpproxy listen mode.")
+	fs.StringVar(&s.TokenSigningKey, "token-signing-key", s.TokenSigningKey,
+		"The HMAC key used to sign the tokens, the server endpoint should use the Signed token parser plugin with the same key. "+
+			"Empty means the tokens aren't signed.")
+	fs.DurationVar(&s.TokenTTL, "token-ttl", s.TokenTTL,
+		"The signed tokens expire after the duration.")
+	fs.StringVar(&s.TokenEncryptionKey, "token-encryption-key", s.TokenEncryptionKey,
+		"The AES key like [kid:]base64(key) used to encrypt the tokens, the server endpoint should use the Encrypted "+
+			"token parser plugin with the same key. Empty means the tokens aren't encrypted.")
+	fs.IntVar(&s.TokenLength, "token-length", s.TokenLength,
+		"The length of the tokens in the v1 handshake, it must be same as the server endpoint's. "+
+			"The longer tokens are refused instead of being truncated.")
+	fs.IntVar(&s.HandshakeVersion, "handshake-version", s.HandshakeVersion,
+		"The version of the handshake protocol, 1 or 2. The v2 handshake carries the variable-length token, "+
+			"metadata and error message, use 1 to connect the server endpoints which don't support v2.")
+	fs.DurationVar(&s.ReconnectInitialInterval, "reconnect-initial-interval", s.ReconnectInitialInterval,
+		"The interval before the first attempt to re-dial server endpoint once the QUIC session is broken, "+
+			"the interval doubles after each failed attempt.")
+	fs.DurationVar(&s.ReconnectMaxInterval, "reconnect-max-interval", s.ReconnectMaxInterval,
+		"The upper limit of the interval between two attempts to re-dial server endpoint.")
+	fs.IntVar(&s.ReconnectMaxRetries, "reconnect-max-retries", s.ReconnectMaxRetries,
+		"Give up re-dialing server endpoint after the number of failed attempts, 0 means retry forever.")
+	fs.DurationVar(&s.DrainTimeout, "drain-timeout", s.DrainTimeout,
+		"The max time to wait for the active tunnels to finish when the endpoint is shutting down.")
+	fs.DurationVar(&s.UDPIdleTimeout, "udp-idle-timeout", s.UDPIdleTimeout,
+		"The UDP flow is closed after it is idle for the duration.")
+	fs.IntVar(&s.PoolSize, "pool-size", s.PoolSize,
+		"The number of the QUIC sessions with server endpoint, the new tunnels are spread over them, "+
+			"so that a bulk transfer doesn't eat the flow control and congestion windows of the other tunnels.")
+	fs.StringVar(&s.PoolStrategy, "pool-strategy", s.PoolStrategy,
+		"The strategy to assign the new tunnels to the QUIC sessions. Support values: least-streams, the healthy "+
+			"session with the least active tunnels; forward-rule, the tunnels of a forward rule use the same session.")
+	s.HttpToken.AddFlags(fs)
+	s.ExecToken.AddFlags(fs)
+	s.Transport.AddFlags(fs)
+}
+
+// Validate checks whether the options are valid.
+func (s *ClientOptions) Validate() error {
+	endpoints := s.GetServerEndpoints()
+	if len(endpoints) == 0 {
+		return fmt.Errorf("the server endpoint address must be specified")
+	}
+	for _, e := range endpoints {
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			return fmt.Errorf("the server endpoint address %s is invalid: %w", e.Address, err)
+		}
+		if e.Priority < 0 || e.Weight < 0 {
+			return fmt.Errorf("the priority and weight of server endpoint %s mustn't be negative", e.Address)
+		}
+	}
+	if s.ServerStrategy != "active-passive" && s.ServerStrategy != "round-robin" && s.ServerStrategy != "lowest-rtt" {
+		return fmt.Errorf("the server strategy %s is invalid, support: active-passive, round-robin, lowest-rtt", s.ServerStrategy)
+	}
+	if s.ProbeInterval < 0 {
+		return fmt.Errorf("the probe interval mustn't be negative")
+	}
+	if s.ProbeInterval > 0 && s.ProbeTimeout <= 0 {
+		return fmt.Errorf("the probe timeout must be positive")
+	}
+	if s.ReconnectInitialInterval <= 0 || s.ReconnectMaxInterval < s.ReconnectInitialInterval {
+		return fmt.Errorf("the reconnect interval is invalid, initial: %s, max: %s",
+			s.ReconnectInitialInterval, s.ReconnectMaxInterval)
+	}
+	if s.ReconnectMaxRetries < 0 {
+		return fmt.Errorf("the reconnect max retries mustn't be negative")
+	}
+	if s.DrainTimeout < 0 {
+		return fmt.Errorf("the drain timeout mustn't be negative")
+	}
+	if s.UDPIdleTimeout <= 0 {
+		return fmt.Errorf("the UDP idle timeout must be positive")
+	}
+	if s.PoolSize <= 0 {
+		return fmt.Errorf("the pool size must be positive")
+	}
+	if s.PoolStrategy != "least-streams" && s.PoolStrategy != "forward-rule" {
+		return fmt.Errorf("the pool strategy %s is invalid, support: least-streams, forward-rule", s.PoolStrategy)
+	}
+	if s.TokenSigningKey != "" && s.TokenEncryptionKey != "" {
+		return fmt.Errorf("the token signing key and encryption key can't be specified together")
+	}
+	if s.TokenSigningKey != "" && s.TokenTTL <= 0 {
+		return fmt.Errorf("the token TTL must be positive")
+	}
+	if s.TokenLength <= 0 || s.TokenLength > constants.MaxTokenLength {
+		return fmt.Errorf("the token length must be in range (0, %d]", constants.MaxTokenLength)
+	}
+	if s.HandshakeVersion != 1 && s.HandshakeVersion != 2 {
+		return fmt.Errorf("the handshake version must be 1 or 2")
+	}
+	if err := s.HttpToken.Validate(); err != nil {
+		return err
+	}
+	if err := s.ExecToken.Validate(); err != nil {
+		return err
+	}
+	if err := s.Transport.Validate(); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, f := range s.GetForwards() {
+		if names[f.Name] {
+			return fmt.Errorf("the forward rule name %s is duplicate", f.Name)
+		}
+		names[f.Name] = true
+		if err := ValidateSocket(f.ListenOn, "tcp", "unix", "udp", "socks5", "httpproxy"); err != nil {
+			return fmt.Errorf("the forward rule %s is invalid: %w", f.Name, err)
+		}
+	}
+	for _, f := range s.GetReverseForwards() {
+		if names[f.Name] {
+			return fmt.Errorf("the forward rule name %s is duplicate", f.Name)
+		}
+		names[f.Name] = true
+		if err := ValidateSocket(f.ConnectTo, "tcp", "unix"); err != nil {
+			return fmt.Errorf("the reverse forward rule %s is invalid: %w", f.Name, err)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("neither forward rule nor reverse forward rule is specified")
+	}
+	return nil
+}
@@ -27,7 +27,7 @@ func AddConfigFlag(basename string, fs *pflag.FlagSet) {
 
 	viper.AutomaticEnv()
 	viper.SetEnvPrefix(strings.Replace(strings.ToUpper(basename), "-", "_", -1))
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 
 	cobra.OnInitialize(func() {
 		if cfgFile != "" {
@@ -0,0 +1,57 @@
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// ExecTokenOptions contains information for the Exec token plugins.
+type ExecTokenOptions struct {
+	Timeout     time.Duration `json:"exec-timeout"     mapstructure:"exec-timeout"`
+	Concurrency int           `json:"exec-concurrency" mapstructure:"exec-concurrency"`
+	CacheTTL    time.Duration `json:"exec-cache-ttl"   mapstructure:"exec-cache-ttl"`
+}
+
+// GetDefaultExecTokenOptions returns a Exec token plugin configuration with default values.
+func GetDefaultExecTokenOptions() ExecTokenOptions {
+	return ExecTokenOptions{
+		Timeout:     5 * time.Second,
+		Concurrency: 16,
+		CacheTTL:    0,
+	}
+}
+
+// PluginConfig returns the config section of the Exec token plugins.
+func (s *ExecTokenOptions) PluginConfig() map[string]any {
+	return map[string]any{
+		"timeout":     s.Timeout,
+		"concurrency": s.Concurrency,
+		"cache-ttl":   s.CacheTTL,
+	}
+}
+
+// AddFlags adds flags for the Exec token plugins to the specified FlagSet.
+func (s *ExecTokenOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&s.Timeout, "exec-timeout", s.Timeout,
+		"The command of the Exec token plugin is killed if it doesn't exit within the duration.")
+	fs.IntVar(&s.Concurrency, "exec-concurrency", s.Concurrency,
+		"The max number of the Exec token plugin's commands running at the same time, 0 means no limit.")
+	fs.DurationVar(&s.CacheTTL, "exec-cache-ttl", s.CacheTTL,
+		"Cache the successful results of the Exec token plugin's command for the duration, 0 means no cache.")
+}
+
+// Validate checks whether the options are valid.
+func (s *ExecTokenOptions) Validate() error {
+	if s.Timeout <= 0 {
+		return fmt.Errorf("the Exec timeout must be positive")
+	}
+	if s.Concurrency < 0 {
+		return fmt.Errorf("the Exec concurrency mustn't be negative")
+	}
+	if s.CacheTTL < 0 {
+		return fmt.Errorf("the Exec cache TTL mustn't be negative")
+	}
+	return nil
+}
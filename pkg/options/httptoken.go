@@ -0,0 +1,107 @@
+package options
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// HttpTokenOptions contains information for the Http token source plugin.
+type HttpTokenOptions struct {
+	Method        string        `json:"http-token-method"         mapstructure:"http-token-method"`
+	Timeout       time.Duration `json:"http-token-timeout"        mapstructure:"http-token-timeout"`
+	Retries       int           `json:"http-token-retries"        mapstructure:"http-token-retries"`
+	RetryInterval time.Duration `json:"http-token-retry-interval" mapstructure:"http-token-retry-interval"`
+	CacheTTL      time.Duration `json:"http-token-cache-ttl"      mapstructure:"http-token-cache-ttl"`
+	BearerToken   string        `json:"http-token-bearer-token"   mapstructure:"http-token-bearer-token"`
+	Username      string        `json:"http-token-username"       mapstructure:"http-token-username"`
+	Password      string        `json:"http-token-password"       mapstructure:"http-token-password"`
+	CertFile      string        `json:"http-token-cert-file"      mapstructure:"http-token-cert-file"`
+	KeyFile       string        `json:"http-token-key-file"       mapstructure:"http-token-key-file"`
+	CaFile        string        `json:"http-token-ca-file"        mapstructure:"http-token-ca-file"`
+}
+
+// GetDefaultHttpTokenOptions returns a Http token source configuration with default values.
+func GetDefaultHttpTokenOptions() HttpTokenOptions {
+	return HttpTokenOptions{
+		Method:        "GET",
+		Timeout:       5 * time.Second,
+		Retries:       2,
+		RetryInterval: 200 * time.Millisecond,
+		CacheTTL:      0,
+	}
+}
+
+// PluginConfig returns the config section of the Http token source plugin.
+func (s *HttpTokenOptions) PluginConfig() map[string]any {
+	return map[string]any{
+		"method":         s.Method,
+		"timeout":        s.Timeout,
+		"retries":        s.Retries,
+		"retry-interval": s.RetryInterval,
+		"cache-ttl":      s.CacheTTL,
+		"bearer-token":   s.BearerToken,
+		"username":       s.Username,
+		"password":       s.Password,
+		"cert-file":      s.CertFile,
+		"key-file":       s.KeyFile,
+		"ca-file":        s.CaFile,
+	}
+}
+
+// AddFlags adds flags for the Http token source plugin to the specified FlagSet.
+func (s *HttpTokenOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&s.Method, "http-token-method", s.Method,
+		"The method of the requests to the token service, GET or POST. The POST request carries the metadata of "+
+			"the client application in a JSON body.")
+	fs.DurationVar(&s.Timeout, "http-token-timeout", s.Timeout,
+		"The timeout of each request to the token service.")
+	fs.IntVar(&s.Retries, "http-token-retries", s.Retries,
+		"The times to retry the request if the token service is unreachable or responds 5xx/429.")
+	fs.DurationVar(&s.RetryInterval, "http-token-retry-interval", s.RetryInterval,
+		"The interval before the first retry, it doubles after each retry.")
+	fs.DurationVar(&s.CacheTTL, "http-token-cache-ttl", s.CacheTTL,
+		"Cache the tokens by client application's address for the duration if the token service's response "+
+			"doesn't have the Cache-Control header, 0 means no cache.")
+	fs.StringVar(&s.BearerToken, "http-token-bearer-token", s.BearerToken,
+		"The bearer token used to authenticate with the token service.")
+	fs.StringVar(&s.Username, "http-token-username", s.Username,
+		"The username used to authenticate with the token service by basic auth.")
+	fs.StringVar(&s.Password, "http-token-password", s.Password,
+		"The password used to authenticate with the token service by basic auth.")
+	fs.StringVar(&s.CertFile, "http-token-cert-file", s.CertFile,
+		"The certificate file used to authenticate with the token service by mTLS.")
+	fs.StringVar(&s.KeyFile, "http-token-key-file", s.KeyFile,
+		"The private key file of --http-token-cert-file.")
+	fs.StringVar(&s.CaFile, "http-token-ca-file", s.CaFile,
+		"The certificate authority file used to verify the token service's certificate. "+
+			"If not specified, the system certificates are used.")
+}
+
+// Validate checks whether the options are valid.
+func (s *HttpTokenOptions) Validate() error {
+	if !strings.EqualFold(s.Method, "GET") && !strings.EqualFold(s.Method, "POST") {
+		return fmt.Errorf("the Http token method must be GET or POST")
+	}
+	if s.Timeout <= 0 {
+		return fmt.Errorf("the Http token timeout must be positive")
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("the Http token retries mustn't be negative")
+	}
+	if s.Retries > 0 && s.RetryInterval <= 0 {
+		return fmt.Errorf("the Http token retry interval must be positive")
+	}
+	if s.CacheTTL < 0 {
+		return fmt.Errorf("the Http token cache TTL mustn't be negative")
+	}
+	if s.BearerToken != "" && s.Username != "" {
+		return fmt.Errorf("the Http token bearer token and username can't be specified together")
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("the Http token cert file and key file must be specified together")
+	}
+	return nil
+}
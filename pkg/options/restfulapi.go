@@ -5,11 +5,14 @@ import "github.com/spf13/pflag"
 // RestfulAPIOptions contains the options while running a API server.
 type RestfulAPIOptions struct {
 	HttpdListenOn string `json:"httpd-listen-on" mapstructure:"httpd-listen-on"`
+	// The bearer token required by the mutating APIs and the APIs which expose the
+	// internal addresses, if it is empty, they only accept the requests from loopback.
+	HttpdToken string `json:"httpd-token" mapstructure:"httpd-token"`
 }
 
 func GetDefaultRestfulAPIOptions() *RestfulAPIOptions {
 	return &RestfulAPIOptions{
-		HttpdListenOn: "0.0.0.0:8086",
+		HttpdListenOn: "127.0.0.1:8086",
 	}
 }
 
@@ -17,4 +20,6 @@ func GetDefaultRestfulAPIOptions() *RestfulAPIOptions {
 func (r *RestfulAPIOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&r.HttpdListenOn, "httpd-listen-on", r.HttpdListenOn,
 		"The socket of the API(httpd) server listen on")
+	fs.StringVar(&r.HttpdToken, "httpd-token", r.HttpdToken,
+		"The bearer token required by the mutating APIs and the APIs which expose the internal addresses, e.g. PUT /maintenance and /catalog. If it is empty, they only accept the requests from loopback")
 }
@@ -1,29 +1,159 @@
-package options
-
-import "github.com/spf13/pflag"
-
-//ServerOptions contains information for a client service.
-type ServerOptions struct {
-	ListenOn          string `json:"listen-on"           mapstructure:"listen-on"`
-	TokenParserPlugin string `json:"token-parser-plugin" mapstructure:"token-parser-plugin"`
-	TokenParserKey    string `json:"token-parser-key"    mapstructure:"token-parser-key"`
-}
-
-// GetDefaultServerOptions returns a server configuration with default values.
-func GetDefaultServerOptions() *ServerOptions {
-	return &ServerOptions{
-		ListenOn:          "0.0.0.0:7500",
-		TokenParserPlugin: "Cleartext",
-		TokenParserKey:    "",
-	}
-}
-
-// AddFlags adds flags for a specific Server to the specified FlagSet.
-func (s *ServerOptions) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&s.ListenOn, "listen-on", s.ListenOn,
-		"The socket that the server side endpoint listen on")
-	fs.StringVar(&s.TokenParserPlugin, "token-parser-plugin", s.TokenParserPlugin,
-		"The token parser plugin.")
-	fs.StringVar(&s.TokenParserKey, "token-parser-key", s.TokenParserKey,
-		"An argument to be passed to the token parse plugin on instantiation.")
-}
+package options
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/spf13/pflag"
+)
+
+// ServerOptions contains information for a client service.
+type ServerOptions struct {
+	ListenOn          string        `json:"listen-on"           mapstructure:"listen-on"`
+	TokenParserPlugin string        `json:"token-parser-plugin" mapstructure:"token-parser-plugin"`
+	TokenParserKey    string        `json:"token-parser-key"    mapstructure:"token-parser-key"`
+	DrainTimeout      time.Duration `json:"drain-timeout"       mapstructure:"drain-timeout"`
+	UDPIdleTimeout    time.Duration `json:"udp-idle-timeout"    mapstructure:"udp-idle-timeout"`
+	AllowReverse      bool          `json:"allow-reverse"       mapstructure:"allow-reverse"`
+	TokenLength       int           `json:"token-length"        mapstructure:"token-length"`
+	// The options of the JWT token parser plugin
+	JWTAudience    string `json:"jwt-audience"     mapstructure:"jwt-audience"`
+	JWTTargetClaim string `json:"jwt-target-claim" mapstructure:"jwt-target-claim"`
+	// The access control policy file of the server applications
+	PolicyFile string `json:"policy-file" mapstructure:"policy-file"`
+	// The file which maps the client endpoint identities to the permitted server applications
+	IdentityMapFile string `json:"identity-map-file" mapstructure:"identity-map-file"`
+	// If the token resolves to a backend group, the backend is chosen by the strategy
+	BackendStrategy    string        `json:"backend-strategy"     mapstructure:"backend-strategy"`
+	BackendDialTimeout time.Duration `json:"backend-dial-timeout" mapstructure:"backend-dial-timeout"`
+	// The health checks of the backends in the catalog of the Catalog token parser plugin
+	HealthCheckInterval time.Duration `json:"health-check-interval" mapstructure:"health-check-interval"`
+	HealthCheckTimeout  time.Duration `json:"health-check-timeout"  mapstructure:"health-check-timeout"`
+	// The options of the Exec token parser plugin
+	ExecToken ExecTokenOptions `mapstructure:",squash"`
+	// The config sections of the token parser plugins, the keys are the plugin names.
+	// They can only be specified in config file.
+	TokenPlugins map[string]map[string]any `json:"token-plugins" mapstructure:"token-plugins"`
+	// The options of the QUIC transport
+	Transport TransportOptions `json:"transport" mapstructure:"transport"`
+}
+
+// GetTokenPluginConfig returns the config section of the token parser plugin.
+// The sections of the JWT and Exec plugins are filled by their flags first,
+// the keys in the token-plugins section override them.
+func (s *ServerOptions) GetTokenPluginConfig(plugin string) map[string]any {
+	plugin = strings.ToLower(plugin)
+	var config map[string]any
+	switch plugin {
+	case "jwt":
+		config = map[string]any{"audience": s.JWTAudience, "target-claim": s.JWTTargetClaim}
+	case "exec":
+		config = s.ExecToken.PluginConfig()
+	}
+	return mergePluginConfig(config, s.TokenPlugins[plugin])
+}
+
+// GetDefaultServerOptions returns a server configuration with default values.
+func GetDefaultServerOptions() *ServerOptions {
+	return &ServerOptions{
+		ListenOn:            "0.0.0.0:7500",
+		TokenParserPlugin:   "Cleartext",
+		TokenParserKey:      "",
+		DrainTimeout:        30 * time.Second,
+		UDPIdleTimeout:      time.Minute,
+		AllowReverse:        false,
+		TokenLength:         constants.TokenLength,
+		JWTAudience:         "",
+		JWTTargetClaim:      "target",
+		PolicyFile:          "",
+		IdentityMapFile:     "",
+		BackendStrategy:     "round-robin",
+		BackendDialTimeout:  5 * time.Second,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		ExecToken:           GetDefaultExecTokenOptions(),
+		Transport:           GetDefaultTransportOptions(),
+	}
+}
+
+// AddFlags adds flags for a specific Server to the specified FlagSet.
+func (s *ServerOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&s.ListenOn, "listen-on", s.ListenOn,
+		"The socket that the server side endpoint listen on")
+	fs.StringVar(&s.TokenParserPlugin, "token-parser-plugin", s.TokenParserPlugin,
+		"The token parser plugin. Support values: Cleartext, Signed, JWT, Encrypted, Catalog, Exec, or the third-party plugins listed by --list-plugins.")
+	fs.StringVar(&s.TokenParserKey, "token-parser-key", s.TokenParserKey,
+		"An argument to be passed to the token parse plugin on instantiation.")
+	fs.DurationVar(&s.DrainTimeout, "drain-timeout", s.DrainTimeout,
+		"The max time to wait for the active tunnels to finish when the endpoint is shutting down.")
+	fs.DurationVar(&s.UDPIdleTimeout, "udp-idle-timeout", s.UDPIdleTimeout,
+		"The UDP flow is closed after it is idle for the duration.")
+	fs.BoolVar(&s.AllowReverse, "allow-reverse", s.AllowReverse,
+		"Allow client endpoints to register reverse forward rules, the token of a registration is parsed "+
+			"by the token parser plugin to get the socket that server endpoint listen on.")
+	fs.IntVar(&s.TokenLength, "token-length", s.TokenLength,
+		"The length of the tokens in the v1 handshake, it must be same as the client endpoints'. "+
+			"The v2 handshake carries the token length, the tokens up to 16384 bytes are accepted.")
+	fs.StringVar(&s.JWTAudience, "jwt-audience", s.JWTAudience,
+		"If it isn't empty, the aud claim of the JWT must contain it. Only used by the JWT token parser plugin.")
+	fs.StringVar(&s.JWTTargetClaim, "jwt-target-claim", s.JWTTargetClaim,
+		"The claim which contains the server application's address. Only used by the JWT token parser plugin.")
+	fs.StringVar(&s.PolicyFile, "policy-file", s.PolicyFile,
+		"The YAML or JSON file of the access control policy, it decides which server applications "+
+			"client endpoints can connect. If not specified, all server applications are allowed.")
+	fs.StringVar(&s.IdentityMapFile, "identity-map-file", s.IdentityMapFile,
+		"The YAML or JSON file which maps the client endpoints' certificate identities to the server applications "+
+			"they can connect, it requires --verify-remote-endpoint. If not specified, the identities aren't checked.")
+	fs.StringVar(&s.BackendStrategy, "backend-strategy", s.BackendStrategy,
+		"If the token resolves to a backend group (a comma separated list of sockets), the strategy decides "+
+			"the order to dial the backends, the next backend is dialed if one fails. "+
+			"Support values: round-robin, least-connections, consistent-hash.")
+	fs.DurationVar(&s.BackendDialTimeout, "backend-dial-timeout", s.BackendDialTimeout,
+		"The timeout to dial each server application.")
+	fs.DurationVar(&s.HealthCheckInterval, "health-check-interval", s.HealthCheckInterval,
+		"Check the health of the TCP/UNIX targets in the catalog of the Catalog token parser plugin periodically, "+
+			"the unhealthy ones are skipped when dialing. 0 means they aren't checked.")
+	fs.DurationVar(&s.HealthCheckTimeout, "health-check-timeout", s.HealthCheckTimeout,
+		"A health check fails if it doesn't finish within the duration.")
+	s.ExecToken.AddFlags(fs)
+	s.Transport.AddFlags(fs)
+}
+
+// Validate checks whether the options are valid.
+func (s *ServerOptions) Validate() error {
+	if s.ListenOn == "" {
+		return fmt.Errorf("the listen address must be specified")
+	}
+	if s.DrainTimeout < 0 {
+		return fmt.Errorf("the drain timeout mustn't be negative")
+	}
+	if s.UDPIdleTimeout <= 0 {
+		return fmt.Errorf("the UDP idle timeout must be positive")
+	}
+	if s.TokenLength <= 0 || s.TokenLength > constants.MaxTokenLength {
+		return fmt.Errorf("the token length must be in range (0, %d]", constants.MaxTokenLength)
+	}
+	switch s.BackendStrategy {
+	case "round-robin", "least-connections", "consistent-hash":
+	default:
+		return fmt.Errorf("the backend strategy %s is invalid, support: round-robin, least-connections, consistent-hash", s.BackendStrategy)
+	}
+	if s.BackendDialTimeout <= 0 {
+		return fmt.Errorf("the backend dial timeout must be positive")
+	}
+	if s.HealthCheckInterval < 0 {
+		return fmt.Errorf("the health check interval mustn't be negative")
+	}
+	if s.HealthCheckInterval > 0 && s.HealthCheckTimeout <= 0 {
+		return fmt.Errorf("the health check timeout must be positive")
+	}
+	if err := s.ExecToken.Validate(); err != nil {
+		return err
+	}
+	if err := s.Transport.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
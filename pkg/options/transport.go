@@ -0,0 +1,98 @@
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The upper limit of the max incoming streams, it is limited by QUIC.
+const maxIncomingStreamsLimit = 1 << 60
+
+// TransportOptions contains the options of the QUIC transport, they are in the
+// transport section of config file, the flags and env variables have the
+// transport prefix, e.g. --transport.max-idle-timeout.
+type TransportOptions struct {
+	HandshakeIdleTimeout time.Duration `json:"handshake-idle-timeout" mapstructure:"handshake-idle-timeout"`
+	MaxIdleTimeout       time.Duration `json:"max-idle-timeout"       mapstructure:"max-idle-timeout"`
+	KeepAlive            bool          `json:"keep-alive"             mapstructure:"keep-alive"`
+	// The flow control windows in bytes, the windows grow from the initial size
+	// up to the max size if the data is consumed quickly enough.
+	InitialStreamReceiveWindow     uint64 `json:"initial-stream-receive-window"     mapstructure:"initial-stream-receive-window"`
+	MaxStreamReceiveWindow         uint64 `json:"max-stream-receive-window"         mapstructure:"max-stream-receive-window"`
+	InitialConnectionReceiveWindow uint64 `json:"initial-connection-receive-window" mapstructure:"initial-connection-receive-window"`
+	MaxConnectionReceiveWindow     uint64 `json:"max-connection-receive-window"     mapstructure:"max-connection-receive-window"`
+	// The max number of the streams the peer can open concurrently, each tunnel is a stream.
+	MaxIncomingStreams int64 `json:"max-incoming-streams" mapstructure:"max-incoming-streams"`
+	// The buffer sizes of the UDP socket in bytes, zero means the system default.
+	UDPReadBuffer  int `json:"udp-read-buffer"  mapstructure:"udp-read-buffer"`
+	UDPWriteBuffer int `json:"udp-write-buffer" mapstructure:"udp-write-buffer"`
+}
+
+// GetDefaultTransportOptions returns a QUIC transport configuration with default values,
+// they are the defaults of quic-go.
+func GetDefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		HandshakeIdleTimeout:           5 * time.Second,
+		MaxIdleTimeout:                 30 * time.Second,
+		KeepAlive:                      false,
+		InitialStreamReceiveWindow:     512 << 10,
+		MaxStreamReceiveWindow:         6 << 20,
+		InitialConnectionReceiveWindow: 512 << 10,
+		MaxConnectionReceiveWindow:     15 << 20,
+		MaxIncomingStreams:             100,
+		UDPReadBuffer:                  0,
+		UDPWriteBuffer:                 0,
+	}
+}
+
+// AddFlags adds flags for the QUIC transport to the specified FlagSet.
+func (s *TransportOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&s.HandshakeIdleTimeout, "transport.handshake-idle-timeout", s.HandshakeIdleTimeout,
+		"The QUIC handshake is aborted if no packet is received from the peer within the duration.")
+	fs.DurationVar(&s.MaxIdleTimeout, "transport.max-idle-timeout", s.MaxIdleTimeout,
+		"The QUIC session is closed if no packet is received from the peer within the duration, "+
+			"the smaller of the two endpoints' values takes effect.")
+	fs.BoolVar(&s.KeepAlive, "transport.keep-alive", s.KeepAlive,
+		"Send packets periodically to keep the QUIC session alive even if there isn't any tunnel.")
+	fs.Uint64Var(&s.InitialStreamReceiveWindow, "transport.initial-stream-receive-window", s.InitialStreamReceiveWindow,
+		"The initial size in bytes of the stream-level flow control window for receiving data.")
+	fs.Uint64Var(&s.MaxStreamReceiveWindow, "transport.max-stream-receive-window", s.MaxStreamReceiveWindow,
+		"The max size in bytes of the stream-level flow control window, raise it for the links with high bandwidth-delay product.")
+	fs.Uint64Var(&s.InitialConnectionReceiveWindow, "transport.initial-connection-receive-window", s.InitialConnectionReceiveWindow,
+		"The initial size in bytes of the connection-level flow control window for receiving data.")
+	fs.Uint64Var(&s.MaxConnectionReceiveWindow, "transport.max-connection-receive-window", s.MaxConnectionReceiveWindow,
+		"The max size in bytes of the connection-level flow control window, it is shared by all tunnels of the session.")
+	fs.Int64Var(&s.MaxIncomingStreams, "transport.max-incoming-streams", s.MaxIncomingStreams,
+		"The max number of the streams the peer can open concurrently, each tunnel uses a stream.")
+	fs.IntVar(&s.UDPReadBuffer, "transport.udp-read-buffer", s.UDPReadBuffer,
+		"The read buffer size in bytes of the UDP socket, 0 means the system default.")
+	fs.IntVar(&s.UDPWriteBuffer, "transport.udp-write-buffer", s.UDPWriteBuffer,
+		"The write buffer size in bytes of the UDP socket, 0 means the system default.")
+}
+
+// Validate checks whether the options are valid.
+func (s *TransportOptions) Validate() error {
+	if s.HandshakeIdleTimeout <= 0 {
+		return fmt.Errorf("the transport handshake idle timeout must be positive")
+	}
+	if s.MaxIdleTimeout <= 0 {
+		return fmt.Errorf("the transport max idle timeout must be positive")
+	}
+	if s.InitialStreamReceiveWindow == 0 || s.MaxStreamReceiveWindow < s.InitialStreamReceiveWindow {
+		return fmt.Errorf("the transport stream receive window is invalid, initial: %d, max: %d",
+			s.InitialStreamReceiveWindow, s.MaxStreamReceiveWindow)
+	}
+	if s.InitialConnectionReceiveWindow == 0 || s.MaxConnectionReceiveWindow < s.InitialConnectionReceiveWindow {
+		return fmt.Errorf("the transport connection receive window is invalid, initial: %d, max: %d",
+			s.InitialConnectionReceiveWindow, s.MaxConnectionReceiveWindow)
+	}
+	if s.MaxIncomingStreams <= 0 || s.MaxIncomingStreams > maxIncomingStreamsLimit {
+		return fmt.Errorf("the transport max incoming streams must be in range (0, %d]", int64(maxIncomingStreamsLimit))
+	}
+	if s.UDPReadBuffer < 0 || s.UDPWriteBuffer < 0 {
+		return fmt.Errorf("the transport UDP buffer sizes mustn't be negative")
+	}
+	return nil
+}
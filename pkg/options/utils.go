@@ -5,9 +5,13 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/gosuri/uitable"
+	"github.com/kungze/quic-tun/pkg/classifier"
+	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -39,6 +43,63 @@ func PrintConfig() {
 	}
 }
 
+// ValidateSocket checks whether the socket is like '<scheme>:<address>' and the
+// scheme is one of the schemes.
+func ValidateSocket(socket string, schemes ...string) error {
+	parts := strings.SplitN(socket, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("the socket %s is invalid, it should be like <scheme>:<address>", socket)
+	}
+	for _, scheme := range schemes {
+		if strings.ToLower(parts[0]) == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("the scheme of the socket %s is invalid, support: %s", socket, strings.Join(schemes, ", "))
+}
+
+// PrintPlugins prints the plugins registered in the endpoint, which are compiled in
+// the binary. The endpoint is either constants.ClientEndpoint or constants.ServerEndpoint.
+func PrintPlugins(endpoint string) {
+	table := uitable.New()
+	table.Separator = "  "
+	table.MaxColWidth = 80
+	table.Wrap = true
+	if endpoint == constants.ClientEndpoint {
+		table.AddRow("TOKEN SOURCE PLUGIN", "DESCRIPTION")
+		for _, p := range token.TokenSourcePlugins() {
+			table.AddRow(p.Name, p.Description)
+		}
+	} else {
+		table.AddRow("TOKEN PARSER PLUGIN", "DESCRIPTION")
+		for _, p := range token.TokenParserPlugins() {
+			table.AddRow(p.Name, p.Description)
+		}
+	}
+	table.AddRow("", "")
+	table.AddRow("DISCRIMINATOR", "DESCRIPTION")
+	for _, d := range classifier.Discriminators() {
+		table.AddRow(d.Name, d.Description)
+	}
+	fmt.Println(table)
+}
+
+// mergePluginConfig returns the config section which is the base overridden by
+// the keys of the override.
+func mergePluginConfig(base map[string]any, override map[string]any) map[string]any {
+	if len(override) == 0 {
+		return base
+	}
+	config := make(map[string]any, len(base)+len(override))
+	for k, v := range base {
+		config[k] = v
+	}
+	for k, v := range override {
+		config[k] = v
+	}
+	return config
+}
+
 // HomeDir returns the home directory for the current user.
 // On Windows:
 // 1. the first of %HOME%, %HOMEDRIVE%%HOMEPATH%, %USERPROFILE% containing a `.apimachinery\config` file is returned.
@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/spf13/viper"
+)
+
+// IdentityMapping permits the client endpoints whose identity matches any of the
+// identities to connect the server applications which match any of the targets.
+type IdentityMapping struct {
+	// The certificate identities of the client endpoints, they can be shell
+	// patterns, e.g. spiffe://example.org/ns/prod/*
+	Identities []string `json:"identities" mapstructure:"identities"`
+	// The server applications' addresses parsed from the tokens, they can be
+	// shell patterns, e.g. tcp:10.0.0.*:22
+	Targets []string `json:"targets" mapstructure:"targets"`
+}
+
+// IdentityMap decides which server applications each client endpoint identity
+// can connect, the targets of all matched mappings are permitted.
+type IdentityMap struct {
+	Mappings []IdentityMapping `json:"mappings" mapstructure:"mappings"`
+}
+
+// LoadIdentityMap reads the identity map from a YAML or JSON file.
+func LoadIdentityMap(file string) (*IdentityMap, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read identity map file %s: %w", file, err)
+	}
+	m := &IdentityMap{}
+	if err := v.Unmarshal(m); err != nil {
+		return nil, fmt.Errorf("failed to decode identity map file %s: %w", file, err)
+	}
+	for i, mapping := range m.Mappings {
+		if len(mapping.Identities) == 0 || len(mapping.Targets) == 0 {
+			return nil, fmt.Errorf("the mapping #%d of identity map file %s must have identities and targets", i+1, file)
+		}
+		for _, pattern := range append(mapping.Identities, mapping.Targets...) {
+			if _, err := path.Match(pattern, ""); errors.Is(err, path.ErrBadPattern) {
+				return nil, fmt.Errorf("the pattern %s of identity map file %s is invalid", pattern, file)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Permitted reports whether the identities can connect the target, the client
+// endpoints without certificate have no identity, so they are never permitted.
+func (m *IdentityMap) Permitted(identities []string, target string) bool {
+	for _, mapping := range m.Mappings {
+		if matchAny(mapping.Identities, identities) && matchAny(mapping.Targets, []string{target}) {
+			return true
+		}
+	}
+	return false
+}
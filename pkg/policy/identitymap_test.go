@@ -0,0 +1,65 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityMapPermitted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identity-map.yaml")
+	content := `mappings:
+  - identities: ["spiffe://example.org/ns/prod/*"]
+    targets: ["tcp:10.0.0.*:22", "unix:/var/run/app/*"]
+  - identities: ["ops.example.com", "admin@example.com"]
+    targets: ["*"]
+`
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadIdentityMap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		identities []string
+		target     string
+		permitted  bool
+	}{
+		{"SPIFFE ID pattern", []string{"spiffe://example.org/ns/prod/web"}, "tcp:10.0.0.5:22", true},
+		{"SPIFFE ID on another port", []string{"spiffe://example.org/ns/prod/web"}, "tcp:10.0.0.5:3306", false},
+		{"SPIFFE ID in another namespace", []string{"spiffe://example.org/ns/dev/web"}, "tcp:10.0.0.5:22", false},
+		{"unix target pattern", []string{"spiffe://example.org/ns/prod/web"}, "unix:/var/run/app/web.sock", true},
+		{"any of the identities", []string{"client.example.com", "spiffe://example.org/ns/prod/db"}, "tcp:10.0.0.6:22", true},
+		{"case-insensitive identity", []string{"OPS.example.com"}, "tcp:192.168.1.1:443", true},
+		{"email identity", []string{"admin@example.com"}, "unix:/var/run/docker.sock", true},
+		{"unknown identity", []string{"guest.example.com"}, "tcp:10.0.0.5:22", false},
+		{"no identity", nil, "tcp:10.0.0.5:22", false},
+	}
+	for _, tt := range tests {
+		if permitted := m.Permitted(tt.identities, tt.target); permitted != tt.permitted {
+			t.Errorf("%s: got %v, want %v", tt.name, permitted, tt.permitted)
+		}
+	}
+}
+
+func TestLoadIdentityMapInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing targets", "mappings:\n  - identities: [\"ops.example.com\"]\n"},
+		{"missing identities", "mappings:\n  - targets: [\"*\"]\n"},
+		{"bad pattern", "mappings:\n  - identities: [\"ops.example.com\"]\n    targets: [\"tcp:[10.0.0.1:22\"]\n"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "identity-map.yaml")
+		if err := os.WriteFile(file, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIdentityMap(file); err == nil {
+			t.Errorf("%s: the identity map is loaded", tt.name)
+		}
+	}
+}
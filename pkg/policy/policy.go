@@ -0,0 +1,282 @@
+// Package policy implements the access control of the server applications,
+// server endpoint evaluates the policy after the token is parsed and before it
+// connects the server application.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// The actions of the rules
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// ErrDenied is returned by Resolve if the server application is denied by the policy.
+var ErrDenied = errors.New("denied by policy")
+
+// Rule matches the server applications, all of the non-empty conditions must
+// be met, and a condition is met if any of its values matches.
+type Rule struct {
+	Name   string `json:"name"   mapstructure:"name"`
+	Action string `json:"action" mapstructure:"action"`
+	// The certificate identities of the client endpoint, they can be shell patterns.
+	// The identities are the subject common name, DNS names, email addresses and URIs.
+	Identities []string `json:"identities" mapstructure:"identities"`
+	Schemes    []string `json:"schemes"    mapstructure:"schemes"`
+	// The hostnames in the token, they can be shell patterns, e.g. *.example.com
+	Hosts []string `json:"hosts" mapstructure:"hosts"`
+	// The CIDRs which the resolved IP must belong to
+	CIDRs []string `json:"cidrs" mapstructure:"cidrs"`
+	// The ports or port ranges, e.g. 22 or 8000-9000
+	Ports []string `json:"ports" mapstructure:"ports"`
+	// The path prefixes of the UNIX sockets
+	UnixPaths []string `json:"unix-paths" mapstructure:"unix-paths"`
+
+	networks []*net.IPNet
+	ports    [][2]int
+}
+
+// Policy is a list of rules, the first matched rule decides whether the server
+// application is allowed, if no rule is matched, the default action is taken.
+type Policy struct {
+	Default string `json:"default" mapstructure:"default"`
+	Rules   []Rule `json:"rules"   mapstructure:"rules"`
+}
+
+// Request describes a server application which client endpoint asks to connect.
+type Request struct {
+	Scheme string
+	// The hostname or IP in the token
+	Host string
+	// The resolved IP, the CIDRs are checked against it instead of the hostname
+	IP   net.IP
+	Port int
+	// The path of the UNIX socket
+	Path       string
+	Identities []string
+}
+
+// Load reads the policy from a YAML or JSON file, the default action is deny
+// if it isn't specified.
+func Load(file string) (*Policy, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", file, err)
+	}
+	p := &Policy{}
+	if err := v.Unmarshal(p); err != nil {
+		return nil, fmt.Errorf("failed to decode policy file %s: %w", file, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("the policy file %s is invalid: %w", file, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) compile() error {
+	p.Default = strings.ToLower(p.Default)
+	if p.Default == "" {
+		p.Default = ActionDeny
+	}
+	if p.Default != ActionAllow && p.Default != ActionDeny {
+		return fmt.Errorf("the default action %s isn't allow or deny", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+		rule.Action = strings.ToLower(rule.Action)
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return fmt.Errorf("the action %s of rule %s isn't allow or deny", rule.Action, rule.Name)
+		}
+		for _, cidr := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("the CIDR %s of rule %s is invalid: %w", cidr, rule.Name, err)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+		for _, port := range rule.Ports {
+			low, high, found := strings.Cut(port, "-")
+			if !found {
+				high = low
+			}
+			l, err1 := strconv.Atoi(strings.TrimSpace(low))
+			h, err2 := strconv.Atoi(strings.TrimSpace(high))
+			if err1 != nil || err2 != nil || l < 0 || h > 65535 || l > h {
+				return fmt.Errorf("the port range %s of rule %s is invalid", port, rule.Name)
+			}
+			rule.ports = append(rule.ports, [2]int{l, h})
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(req Request) bool {
+	if len(r.Identities) > 0 && !matchAny(r.Identities, req.Identities) {
+		return false
+	}
+	if len(r.Schemes) > 0 && !matchAny(r.Schemes, []string{req.Scheme}) {
+		return false
+	}
+	// A rule with UNIX socket conditions doesn't match IP sockets, and vice versa.
+	if len(r.UnixPaths) > 0 {
+		if req.Path == "" {
+			return false
+		}
+		found := false
+		for _, prefix := range r.UnixPaths {
+			prefix = filepath.Clean(prefix)
+			if req.Path == prefix || strings.HasPrefix(req.Path, strings.TrimSuffix(prefix, "/")+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Hosts) > 0 || len(r.networks) > 0 || len(r.ports) > 0 {
+		if req.IP == nil {
+			return false
+		}
+	}
+	if len(r.Hosts) > 0 && !matchAny(r.Hosts, []string{strings.ToLower(req.Host)}) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		found := false
+		for _, network := range r.networks {
+			if network.Contains(req.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		found := false
+		for _, ports := range r.ports {
+			if req.Port >= ports[0] && req.Port <= ports[1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny reports whether any of the values matches any of the patterns, the
+// patterns are case-insensitive shell patterns. A "*" in a shell pattern doesn't
+// match "/", so the "*" pattern alone is special-cased to match any value.
+func matchAny(patterns []string, values []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		for _, value := range values {
+			if pattern == "*" {
+				return true
+			}
+			value = strings.ToLower(value)
+			if pattern == value {
+				return true
+			}
+			if matched, err := path.Match(pattern, value); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate returns whether the request is allowed and the name of the matched rule,
+// the name is empty if the default action is taken.
+func (p *Policy) Evaluate(req Request) (bool, string) {
+	for i := range p.Rules {
+		if p.Rules[i].match(req) {
+			return p.Rules[i].Action == ActionAllow, p.Rules[i].Name
+		}
+	}
+	return p.Default == ActionAllow, ""
+}
+
+// Resolve evaluates the policy for the socket, e.g. tcp:example.com:22, and returns
+// the socket which should be dialed. The hostname is resolved here and replaced by
+// the allowed IP, so that the checked IP is the dialed one even if the DNS record
+// changes between them. The unixgram and unixpacket sockets are checked like the
+// UNIX sockets, the other schemes which the rules can't check, e.g. ip, are always
+// denied. If the socket is denied, the error wraps ErrDenied.
+func (p *Policy) Resolve(ctx context.Context, socket string, identities []string) (string, error) {
+	scheme, addr, _ := strings.Cut(socket, ":")
+	scheme = strings.ToLower(scheme)
+	req := Request{Scheme: scheme, Identities: identities}
+	switch scheme {
+	case "unix", "unixgram", "unixpacket":
+		req.Path = filepath.Clean(addr)
+		if allowed, rule := p.Evaluate(req); !allowed {
+			return "", denied(rule)
+		}
+		return scheme + ":" + req.Path, nil
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return "", fmt.Errorf("%w: the scheme %s isn't supported", ErrDenied, scheme)
+	}
+	host, portName, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, scheme, portName)
+	if err != nil {
+		return "", err
+	}
+	req.Host = host
+	req.Port = port
+	var ips []net.IP
+	if host == "" {
+		// Dial connects to the local system if the host is empty
+		ips = []net.IP{net.IPv4(127, 0, 0, 1)}
+	} else if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	var rule string
+	for _, ip := range ips {
+		req.IP = ip
+		var allowed bool
+		if allowed, rule = p.Evaluate(req); allowed {
+			return scheme + ":" + net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", denied(rule)
+}
+
+func denied(rule string) error {
+	if rule == "" {
+		return fmt.Errorf("%w: the default action is deny", ErrDenied)
+	}
+	return fmt.Errorf("%w: rule %s", ErrDenied, rule)
+}
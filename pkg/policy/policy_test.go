@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	p := &Policy{Rules: []Rule{
+		{Name: "metadata", Action: ActionDeny, CIDRs: []string{"169.254.169.254/32"}},
+		{Name: "db", Action: ActionDeny, CIDRs: []string{"10.0.1.0/24"}, Ports: []string{"3306"}},
+		{Name: "internal", Action: ActionAllow, CIDRs: []string{"10.0.0.0/8", "169.254.0.0/16"}, Ports: []string{"22", "3306", "8000-9000"}},
+		{Name: "admins", Action: ActionAllow, Identities: []string{"*.admin.example.com"}, CIDRs: []string{"10.0.1.0/24"}},
+		{Name: "local", Action: ActionAllow, Hosts: []string{"localhost"}, CIDRs: []string{"127.0.0.0/8"}},
+		{Name: "apps", Action: ActionAllow, UnixPaths: []string{"/var/run/app/"}},
+	}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		socket     string
+		identities []string
+		want       string
+		rule       string
+	}{
+		{"allowed by CIDR", "tcp:10.0.2.5:22", nil, "tcp:10.0.2.5:22", ""},
+		{"allowed by port range", "tcp:10.0.2.5:8080", nil, "tcp:10.0.2.5:8080", ""},
+		{"port out of range", "tcp:10.0.2.5:9001", nil, "", "the default action is deny"},
+		{"narrower CIDR denies first", "tcp:10.0.1.5:3306", nil, "", "rule db"},
+		{"narrower CIDR on another port", "tcp:10.0.1.5:22", nil, "tcp:10.0.1.5:22", ""},
+		{"single IP denies first", "tcp:169.254.169.254:22", nil, "", "rule metadata"},
+		{"IP beside the single IP", "tcp:169.254.169.253:22", nil, "tcp:169.254.169.253:22", ""},
+		{"identity doesn't bypass earlier deny", "tcp:10.0.1.5:3306", []string{"alice.admin.example.com"}, "", "rule db"},
+		{"empty host is loopback", "tcp::22", nil, "", "the default action is deny"},
+		{"hostname pinned to allowed IP", "tcp:localhost:22", nil, "tcp:127.0.0.1:22", ""},
+		{"IP without hostname", "tcp:127.0.0.1:22", nil, "", "the default action is deny"},
+		{"unix path prefix", "unix:/var/run/app/web.sock", nil, "unix:/var/run/app/web.sock", ""},
+		{"unix path traversal", "unix:/var/run/app/../docker.sock", nil, "", "the default action is deny"},
+		{"unixpacket is checked as unix", "unixpacket:/var/run/docker.sock", nil, "", "the default action is deny"},
+		{"unixgram path prefix", "unixgram:/var/run/app/log.sock", nil, "unixgram:/var/run/app/log.sock", ""},
+		{"unknown scheme", "ip:10.0.2.5", nil, "", "the scheme ip isn't supported"},
+	}
+	for _, tt := range tests {
+		got, err := p.Resolve(context.Background(), tt.socket, tt.identities)
+		if tt.want != "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if got != tt.want {
+				t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: got %q, %v, want denied", tt.name, got, err)
+		} else if want := ErrDenied.Error() + ": " + tt.rule; err.Error() != want {
+			t.Errorf("%s: got error %q, want %q", tt.name, err, want)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package restfulapi
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/kungze/quic-tun/pkg/log"
 	"github.com/kungze/quic-tun/pkg/tunnel"
@@ -12,24 +17,150 @@ type errorResponse struct {
 	Msg string `json:"message"`
 }
 
-type httpd struct {
+type maintenanceBody struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// Maintainer is implemented by the endpoints which support maintenance mode.
+type Maintainer interface {
+	InMaintenance() bool
+	SetMaintenance(enabled bool)
+}
+
+// Httpd is the API server of an endpoint
+type Httpd struct {
 	// The socket address of the API server listen on
 	ListenAddr string
+	// The bearer token required by the mutating APIs and the protected APIs, if
+	// it is empty, they only accept the requests from loopback.
+	Token string
+	// The additional read-only APIs, the key is the API path
+	getters map[string]func() any
+	// The paths of the APIs which must be authorized like the mutating APIs
+	protected  map[string]bool
+	maintainer Maintainer
+	// The collectors of the "/metrics" API
+	collectors []func() []Metric
 }
 
-func (h *httpd) getAllStreams(w http.ResponseWriter, request *http.Request) {
-	var resp_json []byte
-	var err error
+// AddGetter register a read-only API, the API response the value returned by getter as JSON.
+// It must be called before Run.
+func (h *Httpd) AddGetter(path string, getter func() any) {
+	h.getters[path] = getter
+}
+
+func (h *Httpd) handleGetter(getter func() any) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		var resp_json []byte
+		var err error
+		if request.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			resp_json, _ = json.Marshal(errorResponse{Msg: "Please use GET request method"})
+		} else {
+			resp_json, err = json.Marshal(getter())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				resp_json = []byte(err.Error())
+			}
+		}
+		_, err = w.Write(resp_json)
+		if err != nil {
+			log.Errorw("Encounter error!", "error", err.Error())
+		}
+	}
+}
+
+// AddMetrics register a collector of the "/metrics" API, the API responses the
+// metrics returned by all collectors in the Prometheus text format. It must be
+// called before Run.
+func (h *Httpd) AddMetrics(collect func() []Metric) {
+	h.collectors = append(h.collectors, collect)
+}
+
+func (h *Httpd) handleMetrics(w http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		resp_json, _ = json.Marshal(errorResponse{Msg: "Please use GET request method"})
-	} else {
-		allTuns := tunnel.DataStore.LoadAll()
-		resp_json, err = json.Marshal(allTuns)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			resp_json = []byte(err.Error())
+		resp_json, _ := json.Marshal(errorResponse{Msg: "Please use GET request method"})
+		_, _ = w.Write(resp_json)
+		return
+	}
+	var metrics []Metric
+	for _, collect := range h.collectors {
+		metrics = append(metrics, collect()...)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writeMetrics(w, metrics); err != nil {
+		log.Errorw("Encounter error!", "error", err.Error())
+	}
+}
+
+// SetMaintainer register the "/maintenance" API, GET request query whether the
+// endpoint is in maintenance mode, PUT request turns on/off maintenance mode,
+// the PUT request must be authorized.
+// It must be called before Run.
+func (h *Httpd) SetMaintainer(m Maintainer) {
+	h.maintainer = m
+}
+
+// authorized reports whether the request carries the bearer token, if the token
+// isn't set, only the requests from loopback are authorized.
+func (h *Httpd) authorized(request *http.Request) bool {
+	if h.Token == "" {
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && ip.IsLoopback()
+	}
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	return found && strings.EqualFold(scheme, "Bearer") && subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+func (h *Httpd) unauthorized(w http.ResponseWriter) []byte {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	resp_json, _ := json.Marshal(errorResponse{Msg: "Please specify the token by the Authorization header"})
+	return resp_json
+}
+
+// Protect requires all requests of the APIs to be authorized like the mutating
+// APIs, e.g. the APIs which expose the internal addresses. It must be called before Run.
+func (h *Httpd) Protect(paths ...string) {
+	for _, path := range paths {
+		h.protected[path] = true
+	}
+}
+
+func (h *Httpd) handleProtected(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if !h.authorized(request) {
+			if _, err := w.Write(h.unauthorized(w)); err != nil {
+				log.Errorw("Encounter error!", "error", err.Error())
+			}
+			return
 		}
+		handler(w, request)
+	}
+}
+
+func (h *Httpd) handleMaintenance(w http.ResponseWriter, request *http.Request) {
+	var resp_json []byte
+	var err error
+	switch request.Method {
+	case http.MethodGet:
+		resp_json, _ = json.Marshal(maintenanceBody{Maintenance: h.maintainer.InMaintenance()})
+	case http.MethodPut:
+		var body maintenanceBody
+		if !h.authorized(request) {
+			resp_json = h.unauthorized(w)
+		} else if err = json.NewDecoder(request.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp_json, _ = json.Marshal(errorResponse{Msg: err.Error()})
+		} else {
+			h.maintainer.SetMaintenance(body.Maintenance)
+			resp_json, _ = json.Marshal(maintenanceBody{Maintenance: h.maintainer.InMaintenance()})
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp_json, _ = json.Marshal(errorResponse{Msg: "Please use GET or PUT request method"})
 	}
 	_, err = w.Write(resp_json)
 	if err != nil {
@@ -37,14 +168,37 @@ func (h *httpd) getAllStreams(w http.ResponseWriter, request *http.Request) {
 	}
 }
 
-func (h *httpd) Start() {
-	http.HandleFunc("/tunnels", h.getAllStreams)
-	err := http.ListenAndServe(h.ListenAddr, nil)
-	if err != nil {
-		panic(err)
+// Run starts the API server, it blocks until ctx is canceled or the server
+// encounter error.
+func (h *Httpd) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	handle := func(path string, handler http.HandlerFunc) {
+		if h.protected[path] {
+			handler = h.handleProtected(handler)
+		}
+		mux.HandleFunc(path, handler)
+	}
+	handle("/tunnels", h.handleGetter(func() any { return tunnel.DataStore.LoadAll() }))
+	for path, getter := range h.getters {
+		handle(path, h.handleGetter(getter))
+	}
+	if h.maintainer != nil {
+		handle("/maintenance", h.handleMaintenance)
+	}
+	if len(h.collectors) > 0 {
+		handle("/metrics", h.handleMetrics)
+	}
+	server := &http.Server{Addr: h.ListenAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
 
-func NewHttpd(listenAddr string) httpd {
-	return httpd{ListenAddr: listenAddr}
+func NewHttpd(listenAddr string) *Httpd {
+	return &Httpd{ListenAddr: listenAddr, getters: map[string]func() any{}, protected: map[string]bool{}}
 }
@@ -0,0 +1,82 @@
+package restfulapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeMaintainer struct {
+	enabled bool
+}
+
+func (m *fakeMaintainer) InMaintenance() bool         { return m.enabled }
+func (m *fakeMaintainer) SetMaintenance(enabled bool) { m.enabled = enabled }
+
+func TestMaintenanceAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		remoteAddr    string
+		authorization string
+		status        int
+	}{
+		{"no token from loopback", "", "127.0.0.1:40000", "", http.StatusOK},
+		{"no token from IPv6 loopback", "", "[::1]:40000", "", http.StatusOK},
+		{"no token from remote", "", "192.0.2.1:40000", "", http.StatusUnauthorized},
+		{"token from remote", "secret", "192.0.2.1:40000", "Bearer secret", http.StatusOK},
+		{"lowercase scheme", "secret", "192.0.2.1:40000", "bearer secret", http.StatusOK},
+		{"wrong token", "secret", "192.0.2.1:40000", "Bearer guess", http.StatusUnauthorized},
+		{"missing token from loopback", "secret", "127.0.0.1:40000", "", http.StatusUnauthorized},
+		{"basic scheme", "secret", "192.0.2.1:40000", "Basic secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		m := &fakeMaintainer{}
+		h := NewHttpd("127.0.0.1:0")
+		h.Token = tt.token
+		h.SetMaintainer(m)
+		request := httptest.NewRequest(http.MethodPut, "/maintenance", strings.NewReader(`{"maintenance": true}`))
+		request.RemoteAddr = tt.remoteAddr
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		h.handleMaintenance(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, recorder.Code, tt.status)
+		}
+		if m.enabled != (tt.status == http.StatusOK) {
+			t.Errorf("%s: maintenance mode is %v after the request", tt.name, m.enabled)
+		}
+	}
+}
+
+func TestProtectedGetter(t *testing.T) {
+	h := NewHttpd("127.0.0.1:0")
+	h.Token = "secret"
+	handler := h.handleProtected(h.handleGetter(func() any { return []string{"tcp:10.20.30.5:5432"} }))
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"authorized", "Bearer secret", http.StatusOK},
+		{"without token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, recorder.Code, tt.status)
+		}
+		if leaked := strings.Contains(recorder.Body.String(), "10.20.30.5"); leaked != (tt.status == http.StatusOK) {
+			t.Errorf("%s: the response is %s", tt.name, recorder.Body.String())
+		}
+	}
+}
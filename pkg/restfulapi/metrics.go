@@ -0,0 +1,71 @@
+package restfulapi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The types of the metrics
+const (
+	MetricGauge   = "gauge"
+	MetricCounter = "counter"
+)
+
+// Metric is a sample exposed by the "/metrics" API. The samples with the same
+// name are grouped, the help and type of the first one are used.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func writeMetrics(w io.Writer, metrics []Metric) error {
+	var names []string
+	groups := map[string][]Metric{}
+	for _, m := range metrics {
+		if _, ok := groups[m.Name]; !ok {
+			names = append(names, m.Name)
+		}
+		groups[m.Name] = append(groups[m.Name], m)
+	}
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		group := groups[name]
+		if group[0].Help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, strings.ReplaceAll(group[0].Help, "\n", " "))
+		}
+		if group[0].Type != "" {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, group[0].Type)
+		}
+		for _, m := range group {
+			bw.WriteString(name)
+			if len(m.Labels) > 0 {
+				keys := make([]string, 0, len(m.Labels))
+				for k := range m.Labels {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for i, k := range keys {
+					if i == 0 {
+						bw.WriteByte('{')
+					} else {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, `%s="%s"`, k, labelValueEscaper.Replace(m.Labels[k]))
+				}
+				bw.WriteByte('}')
+			}
+			fmt.Fprintf(bw, " %s\n", strconv.FormatFloat(m.Value, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
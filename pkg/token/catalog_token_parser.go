@@ -0,0 +1,149 @@
+package token
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/spf13/viper"
+)
+
+// CatalogService is a service in the catalog of "Catalog" token parser plugin,
+// the client endpoints use the name as token.
+type CatalogService struct {
+	Name        string   `json:"name"                  mapstructure:"name"`
+	Description string   `json:"description,omitempty" mapstructure:"description"`
+	Targets     []string `json:"targets"               mapstructure:"targets"`
+	// The health check of the TCP/UNIX targets, nil means server endpoint only checks
+	// whether they can be connected.
+	HealthCheck *CatalogHealthCheck `json:"healthCheck,omitempty" mapstructure:"health-check"`
+}
+
+// CatalogHealthCheck is the data exchanged with the targets of a service once
+// they are connected by server endpoint's health checks.
+type CatalogHealthCheck struct {
+	// The data sent to the target, e.g. "PING\r\n"
+	Send string `json:"send,omitempty" mapstructure:"send"`
+	// The check succeeds only if the response contains it, e.g. "SSH-2.0"
+	Expect string `json:"expect,omitempty" mapstructure:"expect"`
+}
+
+// catalog is the parsed content of the catalog file.
+type catalog struct {
+	services []CatalogService
+	// The targets of the services, the multiple targets are joined as a backend group
+	targets map[string]string
+}
+
+// loadCatalog reads the catalog from a YAML or JSON file.
+func loadCatalog(filePath string) (*catalog, error) {
+	v := viper.New()
+	v.SetConfigFile(filePath)
+	if filepath.Ext(filePath) == "" {
+		v.SetConfigType("yaml")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var content struct {
+		Services []CatalogService `mapstructure:"services"`
+	}
+	if err := v.Unmarshal(&content); err != nil {
+		return nil, err
+	}
+	c := &catalog{services: content.Services, targets: map[string]string{}}
+	for _, service := range content.Services {
+		if service.Name == "" {
+			return nil, fmt.Errorf("the service name mustn't be empty")
+		}
+		if _, ok := c.targets[service.Name]; ok {
+			return nil, fmt.Errorf("the service %s is duplicate", service.Name)
+		}
+		if len(service.Targets) == 0 {
+			return nil, fmt.Errorf("the service %s doesn't have any target", service.Name)
+		}
+		for _, target := range service.Targets {
+			if err := validateCatalogTarget(target); err != nil {
+				return nil, fmt.Errorf("the target %s of service %s is invalid: %w", target, service.Name, err)
+			}
+		}
+		c.targets[service.Name] = strings.Join(service.Targets, ",")
+	}
+	return c, nil
+}
+
+func validateCatalogTarget(target string) error {
+	if strings.Contains(target, ",") {
+		return fmt.Errorf("the target mustn't contain comma")
+	}
+	scheme, addr, _ := strings.Cut(target, ":")
+	switch strings.ToLower(scheme) {
+	case "tcp", "udp":
+		_, _, err := net.SplitHostPort(addr)
+		return err
+	case "unix":
+		if addr == "" {
+			return fmt.Errorf("the socket path is empty")
+		}
+		return nil
+	default:
+		return fmt.Errorf("the scheme %s isn't tcp, udp or unix", scheme)
+	}
+}
+
+type catalogTokenParser struct {
+	filePath string
+	// The current *catalog, it is replaced atomically once the file is reloaded
+	catalog atomic.Value
+}
+
+func (t *catalogTokenParser) ParseToken(token string) (string, error) {
+	name := strings.TrimSpace(token)
+	target, ok := t.catalog.Load().(*catalog).targets[name]
+	if !ok {
+		return "", fmt.Errorf("the service %s isn't in the catalog", name)
+	}
+	return target, nil
+}
+
+// Services return the services in the catalog.
+func (t *catalogTokenParser) Services() []CatalogService {
+	return t.catalog.Load().(*catalog).services
+}
+
+// reload reads the catalog again, if the new content is invalid, the error is
+// logged and the old catalog is kept.
+func (t *catalogTokenParser) reload() {
+	c, err := loadCatalog(t.filePath)
+	if err != nil {
+		log.Errorw("Failed to reload the catalog file, keep using the old one.", "file", t.filePath, "error", err.Error())
+		return
+	}
+	t.catalog.Store(c)
+	log.Infow("The catalog file is reloaded.", "file", t.filePath)
+}
+
+// NewCatalogTokenParserPlugin return a "Catalog" type token parser plugin. The
+// token is a service name, it is resolved to the server application's address
+// by the catalog file. If a service has multiple targets, they are resolved to a
+// backend group, server endpoint chooses the backend by its backend strategy.
+// The catalog file is reloaded automatically once it changes.
+func NewCatalogTokenParserPlugin(catalogFile string) (*catalogTokenParser, error) {
+	filePath, err := filepath.Abs(catalogFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := loadCatalog(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the catalog file %s: %w", catalogFile, err)
+	}
+	t := &catalogTokenParser{filePath: filePath}
+	t.catalog.Store(c)
+	if err := watchFile(filePath, t.reload); err != nil {
+		return nil, fmt.Errorf("failed to watch the catalog file: %w", err)
+	}
+	return t, nil
+}
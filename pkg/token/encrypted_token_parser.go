@@ -0,0 +1,60 @@
+package token
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type encryptedTokenParser struct {
+	// The key is the key ID, multiple keys can be active during the key rotation
+	keys map[string]cipher.AEAD
+}
+
+func (t *encryptedTokenParser) ParseToken(token string) (string, error) {
+	kid, encoded, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("the token is malformed")
+	}
+	aead, ok := t.keys[kid]
+	if !ok {
+		return "", fmt.Errorf("the token's key ID %s is unknown", kid)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("the token is malformed")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	target, err := aead.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return "", errors.New("failed to decrypt the token")
+	}
+	return string(target), nil
+}
+
+// NewEncryptedTokenParserPlugin return a "Encrypted" type token parser plugin.
+// The key is a comma separated list of [kid:]base64(key), the token is decrypted
+// by AES-GCM with the key selected by the token's key ID, so that the old and
+// new keys can be active at the same time during the key rotation.
+func NewEncryptedTokenParserPlugin(key string) (*encryptedTokenParser, error) {
+	keys := map[string]cipher.AEAD{}
+	for _, k := range strings.Split(key, ",") {
+		if strings.TrimSpace(k) == "" {
+			continue
+		}
+		kid, aead, err := parseEncryptionKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keys[kid]; ok {
+			return nil, fmt.Errorf("the key ID %s is duplicate", kid)
+		}
+		keys[kid] = aead
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the key of Encrypted token parser plugin must be specified")
+	}
+	return &encryptedTokenParser{keys: keys}, nil
+}
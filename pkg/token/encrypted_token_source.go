@@ -0,0 +1,86 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// parseEncryptionKey parses the key like [kid:]base64(key), the key must be 16,
+// 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+func parseEncryptionKey(key string) (string, cipher.AEAD, error) {
+	kid, encoded, found := strings.Cut(strings.TrimSpace(key), ":")
+	if !found {
+		kid, encoded = "", kid
+	}
+	if strings.Contains(kid, ".") {
+		return "", nil, fmt.Errorf("the key ID %s mustn't contain '.'", kid)
+	}
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("the encryption key %s isn't base64 encoded", kid)
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("the encryption key %s is invalid: %w", kid, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	return kid, aead, nil
+}
+
+// TokenEncryptor encrypts the tokens with AES-GCM, the encrypted tokens can be
+// parsed by the "Encrypted" token parser plugin.
+type TokenEncryptor struct {
+	kid  string
+	aead cipher.AEAD
+}
+
+// NewTokenEncryptor return a token encryptor, the key is like [kid:]base64(key),
+// the server endpoint's "Encrypted" token parser plugin must have the same key.
+func NewTokenEncryptor(key string) (*TokenEncryptor, error) {
+	kid, aead, err := parseEncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenEncryptor{kid: kid, aead: aead}, nil
+}
+
+// Encrypt makes an encrypted token for the target. The token is like
+// kid + "." + base64url(nonce + AES-GCM(target)), the kid is authenticated too.
+func (e *TokenEncryptor) Encrypt(target string) (string, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(target), []byte(e.kid))
+	return e.kid + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+type encryptedTokenSourcePlugin struct {
+	source    TokenSourcePlugin
+	encryptor *TokenEncryptor
+}
+
+func (t encryptedTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t encryptedTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	target, err := GetToken(t.source, ctx)
+	if err != nil {
+		return "", err
+	}
+	return t.encryptor.Encrypt(target)
+}
+
+// NewEncryptedTokenSourcePlugin wraps the source, the token returned by the
+// source is encrypted before it is sent to server endpoint.
+func NewEncryptedTokenSourcePlugin(source TokenSourcePlugin, encryptor *TokenEncryptor) encryptedTokenSourcePlugin {
+	return encryptedTokenSourcePlugin{source: source, encryptor: encryptor}
+}
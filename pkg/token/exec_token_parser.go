@@ -0,0 +1,76 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The input written to the stdin of the "Exec" token parser plugin's command
+type execParserInput struct {
+	Token    string        `json:"token"`
+	Identity *PeerIdentity `json:"identity,omitempty"`
+}
+
+type execTokenParser struct {
+	runner *execRunner
+}
+
+func (t *execTokenParser) ParseToken(token string) (string, error) {
+	claims, err := t.ParseTokenClaims(token)
+	return claims.Target, err
+}
+
+func (t *execTokenParser) ParseTokenClaims(token string) (TokenClaims, error) {
+	return t.ParseTokenIdentity(token, nil)
+}
+
+func (t *execTokenParser) ParseTokenIdentity(token string, identity *PeerIdentity) (TokenClaims, error) {
+	return t.ParseTokenContext(context.Background(), token, identity)
+}
+
+func (t *execTokenParser) ParseTokenContext(ctx context.Context, token string, identity *PeerIdentity) (TokenClaims, error) {
+	env := []string{"QUICTUN_TOKEN=" + token}
+	key := token
+	if identity != nil {
+		env = append(env,
+			"QUICTUN_PEER_IDENTITY="+identity.String(),
+			"QUICTUN_PEER_CN="+identity.CommonName,
+			"QUICTUN_PEER_SPIFFE_ID="+identity.SPIFFEID)
+		// The result may depend on any name of the identity, so the whole identity,
+		// as it is passed in stdin, is a part of the key besides the token.
+		data, _ := json.Marshal(identity)
+		key = string(data) + "\x00" + token
+	}
+	result, err := t.runner.run(ctx, key, env, execParserInput{Token: token, Identity: identity})
+	if err != nil {
+		return TokenClaims{}, err
+	}
+	if !strings.HasPrefix(result, "{") {
+		return TokenClaims{Target: result}, nil
+	}
+	var output struct {
+		Target  string `json:"target"`
+		Subject string `json:"subject"`
+	}
+	if err := json.Unmarshal([]byte(result), &output); err != nil {
+		return TokenClaims{}, fmt.Errorf("the output of the command is invalid JSON: %w", err)
+	}
+	if output.Target == "" {
+		return TokenClaims{}, fmt.Errorf("the output of the command doesn't contain the target")
+	}
+	return TokenClaims{Target: output.Target, Subject: output.Subject}, nil
+}
+
+// NewExecTokenParserPlugin return a "Exec" type token parser plugin. The command
+// is run for each token, the token and client endpoint's identity are passed by
+// the environment variables and the JSON in stdin. The stdout is the target, or
+// a JSON object with the target and subject. A non-zero exit rejects the token.
+func NewExecTokenParserPlugin(command string, config ExecConfig) (*execTokenParser, error) {
+	runner, err := newExecRunner(command, config)
+	if err != nil {
+		return nil, err
+	}
+	return &execTokenParser{runner: runner}, nil
+}
@@ -0,0 +1,51 @@
+package token
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecTokenParserCanceled(t *testing.T) {
+	parser, err := NewExecTokenParserPlugin("sleep 10", ExecConfig{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := ParseTokenContext(ctx, parser, "tcp:10.0.0.1:22", nil); err == nil {
+		t.Fatal("the token is accepted after the ctx is canceled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the parsing returned after %s, the command isn't killed once the ctx is canceled", elapsed)
+	}
+}
+
+func TestExecTokenParserCacheByIdentity(t *testing.T) {
+	// The target depends on the DNS names of the identity, which aren't in its String().
+	script := `input=$(cat); if echo "$input" | grep -q db.example.com; then echo tcp:10.0.0.2:5432; else echo tcp:10.0.0.1:22; fi`
+	parser, err := NewExecTokenParserPlugin("sh", ExecConfig{CacheTTL: time.Minute, Args: []string{"-c", script}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		identity *PeerIdentity
+		target   string
+	}{
+		{"web", &PeerIdentity{CommonName: "client", DNSNames: []string{"web.example.com"}}, "tcp:10.0.0.1:22"},
+		{"same CN with another DNS name", &PeerIdentity{CommonName: "client", DNSNames: []string{"db.example.com"}}, "tcp:10.0.0.2:5432"},
+		{"same CN with another email", &PeerIdentity{CommonName: "client", Emails: []string{"db.example.com@example.com"}}, "tcp:10.0.0.2:5432"},
+		{"cached web", &PeerIdentity{CommonName: "client", DNSNames: []string{"web.example.com"}}, "tcp:10.0.0.1:22"},
+	}
+	for _, tt := range tests {
+		claims, err := parser.ParseTokenIdentity("token", tt.identity)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if claims.Target != tt.target {
+			t.Errorf("%s: got target %s, want %s", tt.name, claims.Target, tt.target)
+		}
+	}
+}
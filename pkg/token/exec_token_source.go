@@ -0,0 +1,267 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default timeout of the command of "Exec" token plugins
+const DefaultExecTimeout = 5 * time.Second
+
+// The max length of the command's stderr shown in the error
+const maxExecStderrLength = 512
+
+// The max size of the command's stdout
+const maxExecOutputSize = 1 << 20
+
+// The max time to wait for the command's stdout and stderr to be closed after it
+// exited, the processes started by the command may inherit and hold them open.
+const execWaitDelay = time.Second
+
+// ExecConfig is the configuration of the "Exec" token source plugin and token parser plugin.
+type ExecConfig struct {
+	// The command is killed if it doesn't exit within the timeout
+	Timeout time.Duration `mapstructure:"timeout"`
+	// The max number of the commands running at the same time, zero means no limit
+	Concurrency int `mapstructure:"concurrency"`
+	// The successful results are cached for the duration, zero means no cache
+	CacheTTL time.Duration `mapstructure:"cache-ttl"`
+	// The arguments of the command. If they are specified, the command is the path
+	// of the executable and isn't split by whitespace, so the path and arguments
+	// can contain spaces. They can only be specified in the config file.
+	Args []string `mapstructure:"args"`
+}
+
+// Validate checks whether the config is valid, the zero values are allowed.
+func (c *ExecConfig) Validate() error {
+	if c.Timeout < 0 || c.Concurrency < 0 || c.CacheTTL < 0 {
+		return errors.New("the timeout, concurrency and cache TTL mustn't be negative")
+	}
+	return nil
+}
+
+// execRunner runs the command, the input is written to its stdin, and the
+// trimmed stdout is the result.
+type execRunner struct {
+	args   []string
+	config ExecConfig
+	// Limits the number of the running commands
+	slots chan struct{}
+
+	mu        sync.Mutex
+	cache     map[string]cachedToken
+	nextPurge time.Time
+}
+
+func newExecRunner(command string, config ExecConfig) (*execRunner, error) {
+	args := strings.Fields(command)
+	if len(config.Args) > 0 && strings.TrimSpace(command) != "" {
+		args = append([]string{command}, config.Args...)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("the command of Exec token plugin must be specified")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultExecTimeout
+	}
+	r := &execRunner{args: args, config: config, cache: map[string]cachedToken{}}
+	if config.Concurrency > 0 {
+		r.slots = make(chan struct{}, config.Concurrency)
+	}
+	return r, nil
+}
+
+// run runs the command, the result is cached by the key if CacheTTL is positive.
+// The command is killed once the ctx is done or the timeout is reached.
+func (r *execRunner) run(ctx context.Context, key string, env []string, input any) (string, error) {
+	if result, ok := r.cached(key); ok {
+		return result, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+			defer func() { <-r.slots }()
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return "", errors.New("canceled while waiting for the running commands")
+			}
+			return "", errors.New("too many commands are running, timeout to wait")
+		}
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	stdout, err := newExecOutput(maxExecOutputSize)
+	if err != nil {
+		return "", err
+	}
+	stderr, err := newExecOutput(maxExecStderrLength)
+	if err != nil {
+		stdout.close()
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, r.args[0], r.args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout.w
+	cmd.Stderr = stderr.w
+	err = cmd.Run()
+	deadline := time.Now().Add(execWaitDelay)
+	output, msg := stdout.wait(deadline), strings.TrimSpace(stderr.wait(deadline))
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return "", fmt.Errorf("the command %s was canceled", r.args[0])
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("the command %s timed out after %s", r.args[0], r.config.Timeout)
+		}
+		return "", fmt.Errorf("the command %s failed: %w, stderr: %s", r.args[0], err, msg)
+	}
+	result := strings.TrimSpace(output)
+	if result == "" {
+		return "", fmt.Errorf("the command %s returned an empty result", r.args[0])
+	}
+	r.store(key, result)
+	return result, nil
+}
+
+// execOutput collects an output of the command by a pipe. The pipe is passed to
+// the command as a file, so that waiting for the command doesn't wait for the
+// processes which inherit it, like cmd.WaitDelay of the newer Go versions.
+type execOutput struct {
+	r, w *os.File
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+func newExecOutput(limit int64) (*execOutput, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	o := &execOutput{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		defer close(o.done)
+		_, _ = io.Copy(&o.buf, io.LimitReader(r, limit))
+		// The excess output is discarded, so that the command isn't blocked by writing
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	return o, nil
+}
+
+// wait returns the collected output after the command exited. If the pipe is
+// still held open by the other processes, it is closed at the deadline.
+func (o *execOutput) wait(deadline time.Time) string {
+	o.w.Close()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-o.done:
+	case <-timer.C:
+	}
+	o.r.Close()
+	<-o.done
+	return o.buf.String()
+}
+
+func (o *execOutput) close() {
+	o.w.Close()
+	o.r.Close()
+	<-o.done
+}
+
+func (r *execRunner) cached(key string) (string, bool) {
+	if r.config.CacheTTL <= 0 {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.cache[key]
+	if !ok || time.Now().After(c.expiry) {
+		return "", false
+	}
+	return c.token, true
+}
+
+func (r *execRunner) store(key string, result string) {
+	if r.config.CacheTTL <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.After(r.nextPurge) {
+		for k, c := range r.cache {
+			if now.After(c.expiry) {
+				delete(r.cache, k)
+			}
+		}
+		r.nextPurge = now.Add(time.Minute)
+	}
+	r.cache[key] = cachedToken{token: result, expiry: now.Add(r.config.CacheTTL)}
+}
+
+// The metadata written to the stdin of the "Exec" token source plugin's command
+type execSourceInput struct {
+	SourceAddr  string    `json:"sourceAddr"`
+	ListenAddr  string    `json:"listenAddr,omitempty"`
+	ListenPort  int       `json:"listenPort,omitempty"`
+	ForwardRule string    `json:"forwardRule,omitempty"`
+	PeerCred    *PeerCred `json:"peerCred,omitempty"`
+}
+
+type execTokenSourcePlugin struct {
+	runner *execRunner
+}
+
+func (t *execTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t *execTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	env := []string{
+		"QUICTUN_SOURCE_ADDR=" + ctx.SourceAddr,
+		"QUICTUN_LISTEN_ADDR=" + ctx.ListenAddr,
+		"QUICTUN_LISTEN_PORT=" + strconv.Itoa(ctx.ListenPort),
+		"QUICTUN_FORWARD_RULE=" + ctx.ForwardRule,
+	}
+	if ctx.PeerCred != nil {
+		env = append(env,
+			"QUICTUN_PEER_PID="+strconv.Itoa(int(ctx.PeerCred.PID)),
+			"QUICTUN_PEER_UID="+strconv.FormatUint(uint64(ctx.PeerCred.UID), 10),
+			"QUICTUN_PEER_GID="+strconv.FormatUint(uint64(ctx.PeerCred.GID), 10))
+	}
+	return t.runner.run(context.Background(), ctx.cacheKey(), env, execSourceInput{
+		SourceAddr:  ctx.SourceAddr,
+		ListenAddr:  ctx.ListenAddr,
+		ListenPort:  ctx.ListenPort,
+		ForwardRule: ctx.ForwardRule,
+		PeerCred:    ctx.PeerCred,
+	})
+}
+
+// NewExecTokenSourcePlugin return a "Exec" type token source plugin. The command
+// is run for each client application connection, the connection context is
+// passed by the environment variables and the JSON in stdin, the stdout is the
+// token. The command is split by whitespace unless config.Args is specified, it
+// isn't run by shell.
+func NewExecTokenSourcePlugin(command string, config ExecConfig) (*execTokenSourcePlugin, error) {
+	runner, err := newExecRunner(command, config)
+	if err != nil {
+		return nil, err
+	}
+	return &execTokenSourcePlugin{runner: runner}, nil
+}
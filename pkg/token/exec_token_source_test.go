@@ -0,0 +1,62 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecTokenSourceBackgroundProcess(t *testing.T) {
+	// The background process inherits stdout, the token is returned without waiting for it.
+	source, err := NewExecTokenSourcePlugin("sh", ExecConfig{Timeout: 5 * time.Second, Args: []string{"-c", "sleep 10 & echo tcp:10.0.0.1:22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	token, err := source.GetToken("192.168.1.10:50001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "tcp:10.0.0.1:22" {
+		t.Errorf("got token %q, want %q", token, "tcp:10.0.0.1:22")
+	}
+	if elapsed := time.Since(start); elapsed > execWaitDelay+time.Second {
+		t.Errorf("the token is returned after %s, the background process blocked it", elapsed)
+	}
+}
+
+func TestExecTokenSourceCacheByHost(t *testing.T) {
+	dir := t.TempDir()
+	// The command counts its runs in a file, the path contains space.
+	script := filepath.Join(dir, "get token.sh")
+	counter := filepath.Join(dir, "runs")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho run >> \"$1\"\necho tcp:10.0.0.1:22\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewExecTokenSourcePlugin(script, ExecConfig{CacheTTL: time.Minute, Args: []string{counter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		addr string
+		runs int
+	}{
+		{"first connection", "192.168.1.10:50001", 1},
+		{"same host with another port", "192.168.1.10:50002", 1},
+		{"another host", "192.168.1.11:50001", 2},
+	}
+	for _, tt := range tests {
+		if _, err := source.GetTokenContext(&ConnContext{ListenAddr: "127.0.0.1:6500", SourceAddr: tt.addr}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err := os.ReadFile(counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs := len(data) / len("run\n"); runs != tt.runs {
+			t.Errorf("%s: the command ran %d times, want %d", tt.name, runs, tt.runs)
+		}
+	}
+}
@@ -2,35 +2,184 @@ package token
 
 import (
 	"bufio"
-	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+
+	"github.com/kungze/quic-tun/pkg/log"
 )
 
-type fileTokenSourcePlugin struct {
-	filePath string
+// The token of the client applications in a network
+type networkToken struct {
+	network *net.IPNet
+	token   string
+}
+
+// fileTokenTable is the parsed content of the token file.
+type fileTokenTable struct {
+	networks []networkToken
+	// The tokens of the client applications which connect by UNIX socket, the
+	// key is the path of the socket which client endpoint listens on. The peer's
+	// socket path can't be used, it is empty unless the peer binds its socket.
+	unixListeners map[string]string
+	// The token of any client application which connects by UNIX socket
+	unixToken *string
+	// The token of the client applications which don't match any other entry
+	defaultToken *string
+}
+
+// lookup returns the token of the client application's address. For IP address,
+// the entry with the longest prefix wins, so an exact IP beats a CIDR. For UNIX
+// socket, the listenPath is the socket which the client application connected to.
+func (t *fileTokenTable) lookup(addr string, listenPath string) (string, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			best, found := -1, ""
+			for _, n := range t.networks {
+				if ones, _ := n.network.Mask.Size(); ones > best && n.network.Contains(ip) {
+					best, found = ones, n.token
+				}
+			}
+			if best >= 0 {
+				return found, true
+			}
+			if t.defaultToken != nil {
+				return *t.defaultToken, true
+			}
+			return "", false
+		}
+	}
+	if token, ok := t.unixListeners[listenPath]; ok && listenPath != "" {
+		return token, true
+	}
+	if t.unixToken != nil {
+		return *t.unixToken, true
+	}
+	if t.defaultToken != nil {
+		return *t.defaultToken, true
+	}
+	return "", false
 }
 
-func (t fileTokenSourcePlugin) GetToken(addr string) (string, error) {
-	ipAddr := strings.Split(addr, ":")[0]
-	file, err := os.Open(t.filePath)
+// parseTokenFile parses the token file, each line is a client application's
+// address and its token separated by whitespace. The address can be an IP, a
+// CIDR, "unix", "unix:<path>" or "default". The empty lines and the lines start
+// with "#" are ignored.
+func parseTokenFile(filePath string) (*fileTokenTable, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
+	table := &fileTokenTable{unixListeners: map[string]string{}}
+	seen := map[string]int{}
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, ipAddr) {
-			return strings.Split(line, " ")[1], nil
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: the line must be an address and a token separated by whitespace", filePath, lineNo)
+		}
+		match, token := fields[0], fields[1]
+		key := match
+		switch {
+		case strings.EqualFold(match, "default"):
+			key = "default"
+			table.defaultToken = &token
+		case strings.EqualFold(match, "unix"):
+			key = "unix"
+			table.unixToken = &token
+		case strings.HasPrefix(strings.ToLower(match), "unix:"):
+			table.unixListeners[filepath.Clean(match[len("unix:"):])] = token
+		default:
+			var network *net.IPNet
+			if strings.Contains(match, "/") {
+				if _, network, err = net.ParseCIDR(match); err != nil {
+					return nil, fmt.Errorf("%s:%d: the CIDR %s is invalid", filePath, lineNo, match)
+				}
+			} else {
+				ip := net.ParseIP(match)
+				if ip == nil {
+					return nil, fmt.Errorf("%s:%d: the address %s is invalid", filePath, lineNo, match)
+				}
+				bits := net.IPv6len * 8
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, net.IPv4len*8
+				}
+				network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			}
+			key = network.String()
+			table.networks = append(table.networks, networkToken{network: network, token: token})
 		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s:%d: the address %s is duplicate with line %d", filePath, lineNo, match, prev)
+		}
+		seen[key] = lineNo
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	return "", errors.New("don't find valid token")
+	return table, nil
+}
+
+type fileTokenSourcePlugin struct {
+	filePath string
+	// The current *fileTokenTable, it is replaced atomically once the file is reloaded
+	table atomic.Value
+}
+
+func (t *fileTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t *fileTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	// The listen address of a UNIX socket is its path, it hasn't a port.
+	listenPath := ""
+	if _, _, err := net.SplitHostPort(ctx.ListenAddr); err != nil && ctx.ListenAddr != "" {
+		listenPath = filepath.Clean(ctx.ListenAddr)
+	}
+	token, ok := t.table.Load().(*fileTokenTable).lookup(ctx.SourceAddr, listenPath)
+	if !ok {
+		return "", fmt.Errorf("don't find valid token for %s", ctx.SourceAddr)
+	}
+	return token, nil
+}
+
+// reload parses the file again, if the new content is invalid, the error is
+// logged and the old table is kept.
+func (t *fileTokenSourcePlugin) reload() {
+	table, err := parseTokenFile(t.filePath)
+	if err != nil {
+		log.Errorw("Failed to reload the token file, keep using the old one.", "file", t.filePath, "error", err.Error())
+		return
+	}
+	t.table.Store(table)
+	log.Infow("The token file is reloaded.", "file", t.filePath)
 }
 
 // NewFileTokenSourcePlugin return a ``File`` type token source plugin.
 // ``File`` type token source plugin will read the token from a file.
-// The tokenSource is the file path.
-func NewFileTokenSourcePlugin(tokenSource string) fileTokenSourcePlugin {
-	return fileTokenSourcePlugin{filePath: tokenSource}
+// The tokenSource is the file path. The file is parsed at once and
+// reloaded automatically once it changes.
+func NewFileTokenSourcePlugin(tokenSource string) (*fileTokenSourcePlugin, error) {
+	filePath, err := filepath.Abs(tokenSource)
+	if err != nil {
+		return nil, err
+	}
+	table, err := parseTokenFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the token file: %w", err)
+	}
+	t := &fileTokenSourcePlugin{filePath: filePath}
+	t.table.Store(table)
+	if err := watchFile(filePath, t.reload); err != nil {
+		return nil, fmt.Errorf("failed to watch the token file: %w", err)
+	}
+	return t, nil
 }
@@ -0,0 +1,54 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTokenSourceLookup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokenfile")
+	content := `# comment
+172.26.106.19 tcp:10.0.0.1:22
+172.26.106.0/24 tcp:10.0.0.2:22
+172.26.0.0/16 tcp:10.0.0.3:22
+2001:db8::/32 tcp:10.0.0.4:22
+unix:/run/quictun/db.sock tcp:10.0.0.5:3306
+unix tcp:10.0.0.6:22
+default tcp:10.0.0.7:22
+`
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewFileTokenSourcePlugin(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		ctx   ConnContext
+		token string
+	}{
+		{"exact IP", ConnContext{SourceAddr: "172.26.106.19:50001", ListenAddr: "127.0.0.1:6500"}, "tcp:10.0.0.1:22"},
+		{"IP with the same prefix", ConnContext{SourceAddr: "172.26.106.191:50001", ListenAddr: "127.0.0.1:6500"}, "tcp:10.0.0.2:22"},
+		{"longest CIDR", ConnContext{SourceAddr: "172.26.106.20:50001", ListenAddr: "127.0.0.1:6500"}, "tcp:10.0.0.2:22"},
+		{"shorter CIDR", ConnContext{SourceAddr: "172.26.107.20:50001", ListenAddr: "127.0.0.1:6500"}, "tcp:10.0.0.3:22"},
+		{"IPv6", ConnContext{SourceAddr: "[2001:db8::1]:50001", ListenAddr: "[::1]:6500"}, "tcp:10.0.0.4:22"},
+		{"no matched IP", ConnContext{SourceAddr: "10.1.1.1:50001", ListenAddr: "127.0.0.1:6500"}, "tcp:10.0.0.7:22"},
+		{"unix listen path", ConnContext{SourceAddr: "", ListenAddr: "/run/quictun/db.sock"}, "tcp:10.0.0.5:3306"},
+		{"unix peer with path", ConnContext{SourceAddr: "/tmp/peer.sock", ListenAddr: "/run/quictun/db.sock"}, "tcp:10.0.0.5:3306"},
+		{"another unix listen path", ConnContext{SourceAddr: "", ListenAddr: "/run/quictun/web.sock"}, "tcp:10.0.0.6:22"},
+		{"unix without context", ConnContext{SourceAddr: "@"}, "tcp:10.0.0.6:22"},
+	}
+	for _, tt := range tests {
+		ctx := tt.ctx
+		token, err := source.GetTokenContext(&ctx)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if token != tt.token {
+			t.Errorf("%s: got token %q, want %q", tt.name, token, tt.token)
+		}
+	}
+}
@@ -1,46 +1,296 @@
 package token
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type httpTokenSourcePlugin struct {
-	urlPath string
+// The default timeout of the requests to the token service
+const DefaultHttpTokenTimeout = 5 * time.Second
+
+// The max size of the token service's response body
+const maxHttpTokenResponseSize = 1 << 20
+
+// HttpTokenConfig is the configuration of the "Http" token source plugin.
+type HttpTokenConfig struct {
+	// GET or POST, the POST request carries the metadata in a JSON body
+	Method  string        `mapstructure:"method"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// The failed requests are retried for the times, the interval doubles after each retry
+	Retries       int           `mapstructure:"retries"`
+	RetryInterval time.Duration `mapstructure:"retry-interval"`
+	// The tokens are cached for the duration if the response doesn't have the
+	// Cache-Control header, zero means the tokens aren't cached.
+	CacheTTL time.Duration `mapstructure:"cache-ttl"`
+	// The credentials of the token service, either bearer token or basic auth
+	BearerToken string `mapstructure:"bearer-token"`
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+	// The certificate and private key used to authenticate with the token
+	// service, and the CA used to verify the token service's certificate.
+	CertFile string `mapstructure:"cert-file"`
+	KeyFile  string `mapstructure:"key-file"`
+	CaFile   string `mapstructure:"ca-file"`
+}
+
+// Validate checks whether the config is valid, the zero values are allowed.
+func (c *HttpTokenConfig) Validate() error {
+	if c.Method != "" && !strings.EqualFold(c.Method, http.MethodGet) && !strings.EqualFold(c.Method, http.MethodPost) {
+		return fmt.Errorf("the method %s isn't GET or POST", c.Method)
+	}
+	if c.Timeout < 0 || c.Retries < 0 || c.RetryInterval < 0 || c.CacheTTL < 0 {
+		return errors.New("the timeout, retries, retry interval and cache TTL mustn't be negative")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("the cert file and key file must be specified together")
+	}
+	return nil
+}
+
+// The metadata sent to the token service in the POST request
+type httpTokenRequest struct {
+	Addr      string `json:"addr"`
+	Network   string `json:"network"`
+	IP        string `json:"ip,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Hostname  string `json:"hostname"`
+	Timestamp int64  `json:"timestamp"`
+	// The connection context of the client application
+	ListenAddr  string    `json:"listenAddr,omitempty"`
+	ListenPort  int       `json:"listenPort,omitempty"`
+	ForwardRule string    `json:"forwardRule,omitempty"`
+	PeerCred    *PeerCred `json:"peerCred,omitempty"`
 }
 
 type result struct {
 	Token string `json:"token"`
 }
 
-func (t httpTokenSourcePlugin) GetToken(addr string) (string, error) {
-	params := url.Values{}
-	url, err := url.Parse(t.urlPath)
+type cachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+type httpTokenSourcePlugin struct {
+	urlPath string
+	config  HttpTokenConfig
+	client  *http.Client
+
+	mu sync.Mutex
+	// The cached tokens, the key is the local listen address and the client application's host
+	cache     map[string]cachedToken
+	nextPurge time.Time
+}
+
+func (t *httpTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t *httpTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	key := ctx.cacheKey()
+	if token, ok := t.cached(key); ok {
+		return token, nil
+	}
+	interval := t.config.RetryInterval
+	for attempt := 0; ; attempt++ {
+		token, ttl, retry, err := t.request(ctx)
+		if err == nil {
+			t.store(key, token, ttl)
+			return token, nil
+		}
+		if !retry || attempt >= t.config.Retries {
+			return "", err
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// request requests the token service once, retry reports whether the error is
+// transient and the request can be retried.
+func (t *httpTokenSourcePlugin) request(ctx *ConnContext) (token string, ttl time.Duration, retry bool, err error) {
+	req, err := t.newRequest(ctx)
 	if err != nil {
-		return "", err
+		return "", 0, false, err
 	}
-	params.Set("addr", addr)
-	url.RawQuery = params.Encode()
-	urlPath := url.String()
-	resp, err := http.Get(urlPath)
+	resp, err := t.client.Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, true, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHttpTokenResponseSize))
 	if err != nil {
-		return "", err
+		return "", 0, true, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return "", 0, retry, fmt.Errorf("the token service responded %s", resp.Status)
 	}
 	var res result
-	_ = json.Unmarshal(body, &res)
-	return res.Token, nil
+	if err := json.Unmarshal(body, &res); err != nil {
+		return "", 0, false, fmt.Errorf("the response of the token service is invalid: %w", err)
+	}
+	if res.Token == "" {
+		return "", 0, false, errors.New("the token service returned an empty token")
+	}
+	return res.Token, t.cacheTTL(resp.Header.Get("Cache-Control")), false, nil
+}
+
+func (t *httpTokenSourcePlugin) newRequest(ctx *ConnContext) (*http.Request, error) {
+	var req *http.Request
+	if strings.EqualFold(t.config.Method, http.MethodPost) {
+		meta := httpTokenRequest{
+			Addr:        ctx.SourceAddr,
+			Network:     "unix",
+			Timestamp:   time.Now().Unix(),
+			ListenAddr:  ctx.ListenAddr,
+			ListenPort:  ctx.ListenPort,
+			ForwardRule: ctx.ForwardRule,
+			PeerCred:    ctx.PeerCred,
+		}
+		if host, port, err := net.SplitHostPort(ctx.SourceAddr); err == nil {
+			meta.Network = "ip"
+			meta.IP = host
+			meta.Port, _ = strconv.Atoi(port)
+		}
+		meta.Hostname, _ = os.Hostname()
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		if req, err = http.NewRequest(http.MethodPost, t.urlPath, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		params := url.Values{}
+		url, err := url.Parse(t.urlPath)
+		if err != nil {
+			return nil, err
+		}
+		params.Set("addr", ctx.SourceAddr)
+		url.RawQuery = params.Encode()
+		if req, err = http.NewRequest(http.MethodGet, url.String(), nil); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if t.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.config.BearerToken)
+	} else if t.config.Username != "" {
+		req.SetBasicAuth(t.config.Username, t.config.Password)
+	}
+	return req, nil
+}
+
+// cacheTTL returns how long the token can be cached according to the
+// Cache-Control header, if the header is absent, the CacheTTL is used.
+func (t *httpTokenSourcePlugin) cacheTTL(cacheControl string) time.Duration {
+	if cacheControl == "" {
+		return t.config.CacheTTL
+	}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			return 0
+		}
+	}
+	return t.config.CacheTTL
+}
+
+func (t *httpTokenSourcePlugin) cached(addr string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.cache[addr]
+	if !ok || time.Now().After(c.expiry) {
+		return "", false
+	}
+	return c.token, true
+}
+
+func (t *httpTokenSourcePlugin) store(addr string, token string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.After(t.nextPurge) {
+		for a, c := range t.cache {
+			if now.After(c.expiry) {
+				delete(t.cache, a)
+			}
+		}
+		t.nextPurge = now.Add(time.Minute)
+	}
+	t.cache[addr] = cachedToken{token: token, expiry: now.Add(ttl)}
 }
 
 // NewHttpTokenPlugin return a ``Http`` type token source plugin.
 // ``Http`` token source plugin will initiate an http request and
 // get the token based on addr
-func NewHttpTokenPlugin(tokenSource string) httpTokenSourcePlugin {
-	return httpTokenSourcePlugin{urlPath: tokenSource}
+func NewHttpTokenPlugin(tokenSource string) *httpTokenSourcePlugin {
+	t, _ := NewHttpTokenSourcePlugin(tokenSource, HttpTokenConfig{})
+	return t
+}
+
+// NewHttpTokenSourcePlugin return a "Http" type token source plugin with the
+// config, the zero values of the config mean GET request with the default
+// timeout, no retry, no cache and no authentication.
+func NewHttpTokenSourcePlugin(tokenSource string, config HttpTokenConfig) (*httpTokenSourcePlugin, error) {
+	config.Method = strings.ToUpper(config.Method)
+	if config.Method == "" {
+		config.Method = http.MethodGet
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHttpTokenTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CertFile != "" || config.CaFile != "" {
+		tlsConfig := &tls.Config{}
+		if config.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the certificate of the token service client: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if config.CaFile != "" {
+			caPemBlock, err := os.ReadFile(config.CaFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the CA file of the token service: %w", err)
+			}
+			certPool := x509.NewCertPool()
+			if !certPool.AppendCertsFromPEM(caPemBlock) {
+				return nil, fmt.Errorf("no certificate is found in the CA file %s", config.CaFile)
+			}
+			tlsConfig.RootCAs = certPool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &httpTokenSourcePlugin{
+		urlPath: tokenSource,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout, Transport: transport},
+		cache:   map[string]cachedToken{},
+	}, nil
 }
@@ -0,0 +1,51 @@
+package token
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpTokenSourceCacheByHost(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{"token": "tcp:10.0.0.1:%d"}`, n)
+	}))
+	defer server.Close()
+	source, err := NewHttpTokenSourcePlugin(server.URL, HttpTokenConfig{CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		ctx      ConnContext
+		token    string
+		requests int32
+	}{
+		{"first connection", ConnContext{ListenAddr: "127.0.0.1:6500", SourceAddr: "192.168.1.10:50001"}, "tcp:10.0.0.1:1", 1},
+		{"same host with another port", ConnContext{ListenAddr: "127.0.0.1:6500", SourceAddr: "192.168.1.10:50002"}, "tcp:10.0.0.1:1", 1},
+		{"another host", ConnContext{ListenAddr: "127.0.0.1:6500", SourceAddr: "192.168.1.11:50001"}, "tcp:10.0.0.1:2", 2},
+		{"another listen address", ConnContext{ListenAddr: "127.0.0.1:6501", SourceAddr: "192.168.1.10:50003"}, "tcp:10.0.0.1:3", 3},
+		{"unix peer", ConnContext{ListenAddr: "/run/app.sock", SourceAddr: "@", PeerCred: &PeerCred{PID: 1, UID: 1000}}, "tcp:10.0.0.1:4", 4},
+		{"same unix user", ConnContext{ListenAddr: "/run/app.sock", SourceAddr: "@", PeerCred: &PeerCred{PID: 2, UID: 1000}}, "tcp:10.0.0.1:4", 4},
+		{"another unix user", ConnContext{ListenAddr: "/run/app.sock", SourceAddr: "@", PeerCred: &PeerCred{PID: 3, UID: 1001}}, "tcp:10.0.0.1:5", 5},
+	}
+	for _, tt := range tests {
+		ctx := tt.ctx
+		token, err := source.GetTokenContext(&ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if token != tt.token {
+			t.Errorf("%s: got token %q, want %q", tt.name, token, tt.token)
+		}
+		if n := atomic.LoadInt32(&requests); n != tt.requests {
+			t.Errorf("%s: the token service got %d requests, want %d", tt.name, n, tt.requests)
+		}
+	}
+}
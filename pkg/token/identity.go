@@ -0,0 +1,66 @@
+package token
+
+import (
+	"crypto/x509"
+	"strings"
+)
+
+// PeerIdentity is the identity of the client endpoint, it is extracted from the
+// certificate which client endpoint presented in the TLS handshake.
+type PeerIdentity struct {
+	CommonName string   `json:"commonName,omitempty"`
+	DNSNames   []string `json:"dnsNames,omitempty"`
+	Emails     []string `json:"emails,omitempty"`
+	URIs       []string `json:"uris,omitempty"`
+	// The SPIFFE ID, it is the URI SAN with spiffe scheme
+	SPIFFEID string `json:"spiffeId,omitempty"`
+}
+
+// NewPeerIdentity returns the identity of the certificate.
+func NewPeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	identity := &PeerIdentity{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+		Emails:     cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+		if strings.EqualFold(uri.Scheme, "spiffe") && identity.SPIFFEID == "" {
+			identity.SPIFFEID = uri.String()
+		}
+	}
+	return identity
+}
+
+// Identities returns all names of the identity, they are the subject common name,
+// DNS names, email addresses and URIs.
+func (p *PeerIdentity) Identities() []string {
+	if p == nil {
+		return nil
+	}
+	var identities []string
+	if p.CommonName != "" {
+		identities = append(identities, p.CommonName)
+	}
+	identities = append(identities, p.DNSNames...)
+	identities = append(identities, p.Emails...)
+	identities = append(identities, p.URIs...)
+	return identities
+}
+
+// String returns the most specific name of the identity, it is used in logs.
+func (p *PeerIdentity) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.SPIFFEID != "" {
+		return p.SPIFFEID
+	}
+	if p.CommonName != "" {
+		return p.CommonName
+	}
+	if names := p.Identities(); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
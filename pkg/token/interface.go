@@ -1,13 +1,96 @@
 package token
 
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
 // Used to provide token to client endpoint
 type TokenSourcePlugin interface {
 	// GetToken return a token string according to the addr (client application address) parameter
 	GetToken(addr string) (string, error)
 }
 
+// ConnContext describes the client application's connection which the token is
+// requested for.
+type ConnContext struct {
+	// The client application's address
+	SourceAddr string
+	// The local address which the client application connected to
+	ListenAddr string
+	ListenPort int
+	// The name of the forward rule which the connection belongs to
+	ForwardRule string
+	// The credentials of the UNIX socket peer, it is nil if the connection isn't
+	// a UNIX socket or the platform doesn't support it.
+	PeerCred *PeerCred
+}
+
+// cacheKey returns the key to cache the token of the connection. The client
+// application's port changes for every connection, so only the host is used,
+// and the UNIX socket peers are distinguished by their user and group.
+func (c *ConnContext) cacheKey() string {
+	source := c.SourceAddr
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	key := c.ListenAddr + " " + source
+	if c.PeerCred != nil {
+		key += fmt.Sprintf(" %d:%d", c.PeerCred.UID, c.PeerCred.GID)
+	}
+	return key
+}
+
+// PeerCred is the credentials of a UNIX socket peer process
+type PeerCred struct {
+	PID int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// ConnContextTokenSource is implemented by the token source plugins which provide
+// the token according to the connection context besides the client application's address.
+type ConnContextTokenSource interface {
+	GetTokenContext(ctx *ConnContext) (string, error)
+}
+
 // Used to parse token which form client endpoint
 type TokenParserPlugin interface {
 	// ParseToken parse the token and return the parse result
 	ParseToken(token string) (string, error)
 }
+
+// TokenClaims is the parse result of a token which carries more information
+// than the server application's address.
+type TokenClaims struct {
+	// The server application's address
+	Target string
+	// Who the token is issued to, it is shown in the tunnel records
+	Subject string
+}
+
+// TokenClaimsParser is implemented by the token parser plugins which can provide
+// the token's claims besides the server application's address.
+type TokenClaimsParser interface {
+	ParseTokenClaims(token string) (TokenClaims, error)
+}
+
+// IdentityTokenParser is implemented by the token parser plugins which parse the
+// token according to the identity of client endpoint. The identity is nil if
+// client endpoint didn't present a certificate.
+type IdentityTokenParser interface {
+	ParseTokenIdentity(token string, identity *PeerIdentity) (TokenClaims, error)
+}
+
+// ContextTokenParser is implemented by the token parser plugins which may take a
+// while to parse the token, the parsing is aborted once the ctx is done.
+type ContextTokenParser interface {
+	ParseTokenContext(ctx context.Context, token string, identity *PeerIdentity) (TokenClaims, error)
+}
+
+// CatalogProvider is implemented by the token parser plugins which resolve the
+// service names by a catalog, the catalog is exposed by the restful API.
+type CatalogProvider interface {
+	Services() []CatalogService
+}
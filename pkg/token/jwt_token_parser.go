@@ -0,0 +1,340 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The allowed clock skew when checking the "exp" and "nbf" claims
+const jwtClockSkew = 30 * time.Second
+
+// The default claim which contains the server application's address
+const DefaultJWTTargetClaim = "target"
+
+// JWTConfig is the config of the JWT token parser plugin.
+type JWTConfig struct {
+	// If it isn't empty, the "aud" claim must contain it
+	Audience string `mapstructure:"audience"`
+	// The claim which contains the server application's address, the default is "target"
+	TargetClaim string `mapstructure:"target-claim"`
+}
+
+// Validate checks whether the config is valid.
+func (c *JWTConfig) Validate() error {
+	return nil
+}
+
+// A key used to verify the JWT signature, the value is []byte for HS256,
+// *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256.
+type jwtKey struct {
+	kid   string
+	value any
+}
+
+type jwtTokenParser struct {
+	keys []jwtKey
+	// If it isn't empty, the "aud" claim must contain it
+	audience    string
+	targetClaim string
+}
+
+func (t *jwtTokenParser) ParseToken(token string) (string, error) {
+	claims, err := t.ParseTokenClaims(token)
+	return claims.Target, err
+}
+
+func (t *jwtTokenParser) ParseTokenClaims(token string) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, errors.New("the JWT is malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return TokenClaims{}, fmt.Errorf("the JWT header is malformed: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, errors.New("the JWT signature is malformed")
+	}
+	if err := t.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return TokenClaims{}, err
+	}
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return TokenClaims{}, fmt.Errorf("the JWT claims are malformed: %w", err)
+	}
+	if err := t.validate(claims); err != nil {
+		return TokenClaims{}, err
+	}
+	target, ok := claims[t.targetClaim].(string)
+	if !ok || target == "" {
+		return TokenClaims{}, fmt.Errorf("the JWT doesn't contain the %s claim", t.targetClaim)
+	}
+	if allowed, ok := claims["allowed_targets"]; ok {
+		if !targetAllowed(target, allowed) {
+			return TokenClaims{}, fmt.Errorf("the target %s isn't in the allowed_targets claim", target)
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	return TokenClaims{Target: target, Subject: subject}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verify checks the signature with the keys which match the alg and kid. The key
+// type must match the alg, so that a public key can't be used as HMAC secret.
+func (t *jwtTokenParser) verify(alg, kid, signed string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	for _, key := range t.keys {
+		if kid != "" && key.kid != "" && kid != key.kid {
+			continue
+		}
+		switch k := key.value.(type) {
+		case []byte:
+			if alg != "HS256" {
+				continue
+			}
+			mac := hmac.New(sha256.New, k)
+			mac.Write([]byte(signed))
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if alg != "RS256" {
+				continue
+			}
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg != "ES256" || len(sig) != 64 {
+				continue
+			}
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(k, hash[:], r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the JWT signature is invalid or the alg %s isn't supported", alg)
+}
+
+// validate checks the "exp", "nbf" and "aud" claims, the "exp" claim is required.
+func (t *jwtTokenParser) validate(claims map[string]any) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("the JWT doesn't contain the exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return errors.New("the JWT is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("the JWT isn't valid yet")
+	}
+	if t.audience != "" {
+		var audiences []any
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []any{aud}
+		case []any:
+			audiences = aud
+		}
+		found := false
+		for _, aud := range audiences {
+			if aud == t.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("the JWT's audience doesn't contain %s", t.audience)
+		}
+	}
+	return nil
+}
+
+// targetAllowed reports whether the target matches one of the allowed targets,
+// the allowed targets can be shell patterns, e.g. tcp:10.0.0.*:22
+func targetAllowed(target string, allowed any) bool {
+	patterns, ok := allowed.([]any)
+	if !ok {
+		return false
+	}
+	for _, p := range patterns {
+		pattern, ok := p.(string)
+		if !ok {
+			continue
+		}
+		if pattern == target {
+			return true
+		}
+		if matched, err := path.Match(pattern, target); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// loadJWTKeys loads the keys from the file. The file can be a JWKS file, a PEM
+// file which contains public keys or certificates, or a HMAC secret.
+func loadJWTKeys(keyFile string) ([]jwtKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if json.Unmarshal(data, &jwks) == nil && jwks.Keys != nil {
+		return parseJWKS(jwks.Keys)
+	}
+	if strings.Contains(string(data), "-----BEGIN") {
+		return parsePEMKeys(data)
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, errors.New("the HMAC secret is empty")
+	}
+	return []jwtKey{{value: secret}}, nil
+}
+
+func parsePEMKeys(data []byte) ([]jwtKey, error) {
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var pub any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch pub.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, jwtKey{value: pub})
+		default:
+			return nil, fmt.Errorf("the public key type %T isn't supported", pub)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key is found in the PEM file")
+	}
+	return keys, nil
+}
+
+func parseJWKS(raws []json.RawMessage) ([]jwtKey, error) {
+	var keys []jwtKey
+	for _, raw := range raws {
+		var jwk struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		}
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, err
+		}
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var value any
+		switch jwk.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 {
+				return nil, fmt.Errorf("the RSA key %s in JWKS is invalid", jwk.Kid)
+			}
+			value = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("the EC key %s in JWKS is invalid", jwk.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("the EC key %s in JWKS is invalid", jwk.Kid)
+			}
+			value = pub
+		case "oct":
+			k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil || len(k) == 0 {
+				return nil, fmt.Errorf("the oct key %s in JWKS is invalid", jwk.Kid)
+			}
+			value = k
+		default:
+			continue
+		}
+		keys = append(keys, jwtKey{kid: jwk.Kid, value: value})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported key is found in the JWKS file")
+	}
+	return keys, nil
+}
+
+// NewJWTTokenParserPlugin return a "JWT" type token parser plugin. The keyFile
+// can be a JWKS file, a PEM file which contains public keys or certificates, or
+// a file which contains the HMAC secret. HS256, RS256 and ES256 are supported.
+// The server application's address is read from the targetClaim, if the token
+// has the "allowed_targets" claim, the address must match one of them.
+func NewJWTTokenParserPlugin(keyFile string, audience string, targetClaim string) (*jwtTokenParser, error) {
+	keys, err := loadJWTKeys(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWT keys from %s: %w", keyFile, err)
+	}
+	if targetClaim == "" {
+		targetClaim = DefaultJWTTargetClaim
+	}
+	return &jwtTokenParser{keys: keys, audience: audience, targetClaim: targetClaim}, nil
+}
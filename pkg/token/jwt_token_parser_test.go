@@ -0,0 +1,152 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type jwtSigner func(t *testing.T, signed string) []byte
+
+func makeJWT(t *testing.T, alg string, claims map[string]any, sign jwtSigner) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(t, signed))
+}
+
+func hs256(secret []byte) jwtSigner {
+	return func(t *testing.T, signed string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(key *rsa.PrivateKey) jwtSigner {
+	return func(t *testing.T, signed string) []byte {
+		hash := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func es256(key *ecdsa.PrivateKey) jwtSigner {
+	return func(t *testing.T, signed string) []byte {
+		hash := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+func TestJWTTokenParser(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pemData []byte
+	for _, pub := range []any{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	pemFile := filepath.Join(dir, "keys.pem")
+	secretFile := filepath.Join(dir, "secret")
+	secret := []byte("shared-secret")
+	if err := os.WriteFile(pemFile, pemData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretFile, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	publicParser, err := NewJWTTokenParserPlugin(pemFile, "quic-tun", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretParser, err := NewJWTTokenParserPlugin(secretFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"target": "tcp:10.0.0.1:22", "sub": "alice", "aud": "quic-tun", "exp": now.Add(time.Minute).Unix()}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		parser *jwtTokenParser
+		token  string
+		err    string
+	}{
+		{"HS256", secretParser, makeJWT(t, "HS256", claims(nil), hs256(secret)), ""},
+		{"HS256 with another secret", secretParser, makeJWT(t, "HS256", claims(nil), hs256([]byte("guess"))), "the JWT signature is invalid or the alg HS256 isn't supported"},
+		{"RS256", publicParser, makeJWT(t, "RS256", claims(nil), rs256(rsaKey)), ""},
+		{"ES256", publicParser, makeJWT(t, "ES256", claims(nil), es256(ecKey)), ""},
+		{"alg none", publicParser, makeJWT(t, "none", claims(nil), func(*testing.T, string) []byte { return nil }), "the JWT signature is invalid or the alg none isn't supported"},
+		{"public key as HMAC secret", publicParser, makeJWT(t, "HS256", claims(nil), hs256(pemData)), "the JWT signature is invalid or the alg HS256 isn't supported"},
+		{"alg mismatches the key", publicParser, makeJWT(t, "ES256", claims(nil), rs256(rsaKey)), "the JWT signature is invalid or the alg ES256 isn't supported"},
+		{"expired", publicParser, makeJWT(t, "RS256", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}), rs256(rsaKey)), "the JWT is expired"},
+		{"expired within clock skew", publicParser, makeJWT(t, "RS256", claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()}), rs256(rsaKey)), ""},
+		{"missing exp", publicParser, makeJWT(t, "RS256", claims(map[string]any{"exp": nil}), rs256(rsaKey)), "the JWT doesn't contain the exp claim"},
+		{"not valid yet", publicParser, makeJWT(t, "RS256", claims(map[string]any{"nbf": now.Add(time.Minute).Unix()}), rs256(rsaKey)), "the JWT isn't valid yet"},
+		{"audience list", publicParser, makeJWT(t, "RS256", claims(map[string]any{"aud": []string{"other", "quic-tun"}}), rs256(rsaKey)), ""},
+		{"another audience", publicParser, makeJWT(t, "RS256", claims(map[string]any{"aud": "other"}), rs256(rsaKey)), "the JWT's audience doesn't contain quic-tun"},
+		{"missing audience", publicParser, makeJWT(t, "RS256", claims(map[string]any{"aud": nil}), rs256(rsaKey)), "the JWT's audience doesn't contain quic-tun"},
+		{"audience isn't required", secretParser, makeJWT(t, "HS256", claims(map[string]any{"aud": nil}), hs256(secret)), ""},
+		{"allowed target", publicParser, makeJWT(t, "RS256", claims(map[string]any{"allowed_targets": []string{"tcp:10.0.0.*:22"}}), rs256(rsaKey)), ""},
+		{"disallowed target", publicParser, makeJWT(t, "RS256", claims(map[string]any{"allowed_targets": []string{"tcp:10.0.1.*:22"}}), rs256(rsaKey)), "the target tcp:10.0.0.1:22 isn't in the allowed_targets claim"},
+		{"missing target", publicParser, makeJWT(t, "RS256", claims(map[string]any{"target": nil}), rs256(rsaKey)), "the JWT doesn't contain the target claim"},
+		{"malformed", publicParser, "tcp:10.0.0.1:22", "the JWT is malformed"},
+	}
+	for _, tt := range tests {
+		result, err := tt.parser.ParseTokenClaims(tt.token)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if result != (TokenClaims{Target: "tcp:10.0.0.1:22", Subject: "alice"}) {
+				t.Errorf("%s: got claims %+v", tt.name, result)
+			}
+		} else if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The built-in plugins are registered like the third-party ones.
+func init() {
+	RegisterTokenSourcePlugin("Fixed", TokenSourceFactory{
+		Description: "Use the token source as the token of all connections.",
+		New: func(source string, _ PluginConfig) (TokenSourcePlugin, error) {
+			return NewFixedTokenPlugin(source), nil
+		},
+	})
+	RegisterTokenSourcePlugin("File", TokenSourceFactory{
+		Description: "Look up the token by the client application's address in a hot-reloaded file.",
+		New: func(source string, _ PluginConfig) (TokenSourcePlugin, error) {
+			plugin, err := NewFileTokenSourcePlugin(source)
+			if err != nil {
+				return nil, err
+			}
+			return plugin, nil
+		},
+	})
+	RegisterTokenSourcePlugin("Http", TokenSourceFactory{
+		Description: "Request the token from an HTTP token service.",
+		NewConfig:   func() PluginConfig { return &HttpTokenConfig{} },
+		New: func(source string, config PluginConfig) (TokenSourcePlugin, error) {
+			plugin, err := NewHttpTokenSourcePlugin(source, *config.(*HttpTokenConfig))
+			if err != nil {
+				return nil, err
+			}
+			return plugin, nil
+		},
+	})
+	RegisterTokenSourcePlugin("Exec", TokenSourceFactory{
+		Description: "Run a command for each connection, its stdout is the token.",
+		NewConfig:   func() PluginConfig { return &ExecConfig{} },
+		New: func(source string, config PluginConfig) (TokenSourcePlugin, error) {
+			plugin, err := NewExecTokenSourcePlugin(source, *config.(*ExecConfig))
+			if err != nil {
+				return nil, err
+			}
+			return plugin, nil
+		},
+	})
+	RegisterTokenSourcePlugin("Template", TokenSourceFactory{
+		Description: "Render the token from a Go template of the connection context.",
+		New: func(source string, _ PluginConfig) (TokenSourcePlugin, error) {
+			plugin, err := NewTemplateTokenSourcePlugin(source)
+			if err != nil {
+				return nil, err
+			}
+			return plugin, nil
+		},
+	})
+
+	RegisterTokenParserPlugin("Cleartext", TokenParserFactory{
+		Description: "Use the token as the server application's address, the key is the enctype, base64 or empty.",
+		New: func(key string, _ PluginConfig) (TokenParserPlugin, error) {
+			return NewCleartextTokenParserPlugin(key), nil
+		},
+	})
+	RegisterTokenParserPlugin("Signed", TokenParserFactory{
+		Description: "Verify the HMAC signature and expiration of the token, the key is the HMAC key.",
+		New: func(key string, _ PluginConfig) (TokenParserPlugin, error) {
+			if key == "" {
+				return nil, errors.New("the key of Signed token parser plugin must be specified")
+			}
+			return NewSignedTokenParserPlugin(key), nil
+		},
+	})
+	RegisterTokenParserPlugin("JWT", TokenParserFactory{
+		Description: "Verify the token as a JWT, the key is a JWKS, PEM or HMAC secret file.",
+		NewConfig:   func() PluginConfig { return &JWTConfig{} },
+		New: func(key string, config PluginConfig) (TokenParserPlugin, error) {
+			c := config.(*JWTConfig)
+			parser, err := NewJWTTokenParserPlugin(key, c.Audience, c.TargetClaim)
+			if err != nil {
+				return nil, err
+			}
+			return parser, nil
+		},
+	})
+	RegisterTokenParserPlugin("Exec", TokenParserFactory{
+		Description: "Run a command for each token, its stdout is the server application's address.",
+		NewConfig:   func() PluginConfig { return &ExecConfig{} },
+		New: func(key string, config PluginConfig) (TokenParserPlugin, error) {
+			parser, err := NewExecTokenParserPlugin(key, *config.(*ExecConfig))
+			if err != nil {
+				return nil, err
+			}
+			return parser, nil
+		},
+	})
+	RegisterTokenParserPlugin("Catalog", TokenParserFactory{
+		Description: "Resolve the token as a service name in a hot-reloaded catalog file.",
+		New: func(key string, _ PluginConfig) (TokenParserPlugin, error) {
+			parser, err := NewCatalogTokenParserPlugin(key)
+			if err != nil {
+				return nil, err
+			}
+			return parser, nil
+		},
+	})
+	RegisterTokenParserPlugin("Encrypted", TokenParserFactory{
+		Description: "Decrypt the AES-GCM encrypted token, the key is a comma separated list of [kid:]base64(key).",
+		New: func(key string, _ PluginConfig) (TokenParserPlugin, error) {
+			parser, err := NewEncryptedTokenParserPlugin(key)
+			if err != nil {
+				return nil, err
+			}
+			return parser, nil
+		},
+	})
+}
+
+// NewTokenSourcePlugin return the token source plugin specified by plugin, the
+// source is the argument to be passed to the plugin on instantiation.
+func NewTokenSourcePlugin(plugin string, source string) (TokenSourcePlugin, error) {
+	return NewTokenSourcePluginWithConfig(plugin, source, nil)
+}
+
+// NewTokenSourcePluginWithConfig is like NewTokenSourcePlugin, the config section
+// is decoded into the plugin's typed config, the missing keys keep the defaults.
+func NewTokenSourcePluginWithConfig(plugin string, source string, section map[string]any) (TokenSourcePlugin, error) {
+	registryMu.RLock()
+	s, ok := sourceFactories[strings.ToLower(plugin)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("the token source plugin %s is invalid", plugin)
+	}
+	config, err := decodePluginConfig(s.name, s.factory.NewConfig, section)
+	if err != nil {
+		return nil, err
+	}
+	return s.factory.New(source, config)
+}
+
+// GetToken gets the token from the source, if the source doesn't implement
+// ConnContextTokenSource, only the client application's address is passed to it.
+func GetToken(source TokenSourcePlugin, ctx *ConnContext) (string, error) {
+	if s, ok := source.(ConnContextTokenSource); ok {
+		return s.GetTokenContext(ctx)
+	}
+	return source.GetToken(ctx.SourceAddr)
+}
+
+// NewTokenParserPlugin return the token parser plugin specified by plugin, the
+// key is the argument to be passed to the plugin on instantiation.
+func NewTokenParserPlugin(plugin string, key string) (TokenParserPlugin, error) {
+	return NewTokenParserPluginWithConfig(plugin, key, nil)
+}
+
+// NewTokenParserPluginWithConfig is like NewTokenParserPlugin, the config section
+// is decoded into the plugin's typed config, the missing keys keep the defaults.
+func NewTokenParserPluginWithConfig(plugin string, key string, section map[string]any) (TokenParserPlugin, error) {
+	registryMu.RLock()
+	p, ok := parserFactories[strings.ToLower(plugin)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("token parser plugin %s don't support", plugin)
+	}
+	config, err := decodePluginConfig(p.name, p.factory.NewConfig, section)
+	if err != nil {
+		return nil, err
+	}
+	return p.factory.New(key, config)
+}
+
+// ParseTokenContext parses the token like ParseTokenIdentity, if the parser
+// implements ContextTokenParser, the parsing is aborted once the ctx is done.
+func ParseTokenContext(ctx context.Context, parser TokenParserPlugin, token string, identity *PeerIdentity) (TokenClaims, error) {
+	if p, ok := parser.(ContextTokenParser); ok {
+		return p.ParseTokenContext(ctx, token, identity)
+	}
+	return ParseTokenIdentity(parser, token, identity)
+}
+
+// ParseTokenIdentity parses the token by the parser with the identity of client
+// endpoint, if the parser doesn't implement IdentityTokenParser, the identity is ignored.
+func ParseTokenIdentity(parser TokenParserPlugin, token string, identity *PeerIdentity) (TokenClaims, error) {
+	if p, ok := parser.(IdentityTokenParser); ok {
+		return p.ParseTokenIdentity(token, identity)
+	}
+	return ParseTokenClaims(parser, token)
+}
+
+// ParseTokenClaims parses the token by the parser, if the parser doesn't
+// implement TokenClaimsParser, only the Target of the claims is filled.
+func ParseTokenClaims(parser TokenParserPlugin, token string) (TokenClaims, error) {
+	if p, ok := parser.(TokenClaimsParser); ok {
+		return p.ParseTokenClaims(token)
+	}
+	target, err := parser.ParseToken(token)
+	return TokenClaims{Target: target}, err
+}
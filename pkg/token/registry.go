@@ -0,0 +1,147 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// PluginConfig is the typed config of a plugin, it is decoded from the plugin's
+// config section and validated before the plugin is created.
+type PluginConfig interface {
+	Validate() error
+}
+
+// TokenSourceFactory creates the token source plugins of a type.
+type TokenSourceFactory struct {
+	// The description shown by --list-plugins
+	Description string
+	// NewConfig returns the config with default values, the config section is
+	// decoded into it. It is nil if the plugin hasn't any config.
+	NewConfig func() PluginConfig
+	// New creates a plugin, the source is the argument specified by --token-source,
+	// the config is decoded and validated, it is nil if NewConfig is nil.
+	New func(source string, config PluginConfig) (TokenSourcePlugin, error)
+}
+
+// TokenParserFactory creates the token parser plugins of a type.
+type TokenParserFactory struct {
+	// The description shown by --list-plugins
+	Description string
+	// NewConfig returns the config with default values, the config section is
+	// decoded into it. It is nil if the plugin hasn't any config.
+	NewConfig func() PluginConfig
+	// New creates a plugin, the key is the argument specified by --token-parser-key,
+	// the config is decoded and validated, it is nil if NewConfig is nil.
+	New func(key string, config PluginConfig) (TokenParserPlugin, error)
+}
+
+// PluginInfo describes a registered plugin.
+type PluginInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type registeredSource struct {
+	name    string
+	factory TokenSourceFactory
+}
+
+type registeredParser struct {
+	name    string
+	factory TokenParserFactory
+}
+
+var (
+	registryMu sync.RWMutex
+	// The keys are the lower case names of the plugins
+	sourceFactories = map[string]registeredSource{}
+	parserFactories = map[string]registeredParser{}
+)
+
+// RegisterTokenSourcePlugin makes a token source plugin available by the name,
+// the name is case-insensitive. It is intended to be called from the init
+// function of the plugin's package, so that a third-party plugin is compiled
+// in by a blank import. It panics if the name is already registered.
+func RegisterTokenSourcePlugin(name string, factory TokenSourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory.New == nil {
+		panic("token: the factory of token source plugin " + name + " is nil")
+	}
+	if _, ok := sourceFactories[strings.ToLower(name)]; ok {
+		panic("token: the token source plugin " + name + " is registered twice")
+	}
+	sourceFactories[strings.ToLower(name)] = registeredSource{name: name, factory: factory}
+}
+
+// RegisterTokenParserPlugin makes a token parser plugin available by the name,
+// the name is case-insensitive. It is intended to be called from the init
+// function of the plugin's package, so that a third-party plugin is compiled
+// in by a blank import. It panics if the name is already registered.
+func RegisterTokenParserPlugin(name string, factory TokenParserFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory.New == nil {
+		panic("token: the factory of token parser plugin " + name + " is nil")
+	}
+	if _, ok := parserFactories[strings.ToLower(name)]; ok {
+		panic("token: the token parser plugin " + name + " is registered twice")
+	}
+	parserFactories[strings.ToLower(name)] = registeredParser{name: name, factory: factory}
+}
+
+// TokenSourcePlugins returns the registered token source plugins sorted by name.
+func TokenSourcePlugins() []PluginInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	plugins := make([]PluginInfo, 0, len(sourceFactories))
+	for _, s := range sourceFactories {
+		plugins = append(plugins, PluginInfo{Name: s.name, Description: s.factory.Description})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+// TokenParserPlugins returns the registered token parser plugins sorted by name.
+func TokenParserPlugins() []PluginInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	plugins := make([]PluginInfo, 0, len(parserFactories))
+	for _, p := range parserFactories {
+		plugins = append(plugins, PluginInfo{Name: p.name, Description: p.factory.Description})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+// decodePluginConfig decodes the config section into the config returned by
+// newConfig and validates it. The unknown keys in the section are refused.
+func decodePluginConfig(plugin string, newConfig func() PluginConfig, section map[string]any) (PluginConfig, error) {
+	if newConfig == nil {
+		if len(section) > 0 {
+			return nil, fmt.Errorf("the plugin %s doesn't accept any config", plugin)
+		}
+		return nil, nil
+	}
+	config := newConfig()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(section); err != nil {
+		return nil, fmt.Errorf("the config of plugin %s is invalid: %w", plugin, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("the config of plugin %s is invalid: %w", plugin, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,84 @@
+package token
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The allowed clock skew between client endpoint and server endpoint
+const signedTokenClockSkew = 30 * time.Second
+
+type signedTokenParser struct {
+	key []byte
+	mu  sync.Mutex
+	// The nonces of the used tokens, the value is the token's expiry. A nonce
+	// can be forgotten after the token expired, because the token is rejected anyway.
+	nonces    map[string]time.Time
+	nextPurge time.Time
+}
+
+func (t *signedTokenParser) ParseToken(token string) (string, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("the token is malformed")
+	}
+	actual, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(actual, signature(t.key, encoded)) {
+		return "", errors.New("the token's signature is invalid")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("the token's payload is malformed")
+	}
+	var payload signedPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return "", errors.New("the token's payload is malformed")
+	}
+	now := time.Now()
+	if time.Unix(payload.IssuedAt, 0).After(now.Add(signedTokenClockSkew)) {
+		return "", errors.New("the token is issued in the future")
+	}
+	expiry := time.Unix(payload.Expiry, 0)
+	if now.After(expiry.Add(signedTokenClockSkew)) {
+		return "", errors.New("the token is expired")
+	}
+	if payload.Nonce == "" {
+		return "", errors.New("the token's nonce is missing")
+	}
+	if !t.useNonce(payload.Nonce, expiry.Add(signedTokenClockSkew), now) {
+		return "", errors.New("the token is replayed")
+	}
+	return payload.Target, nil
+}
+
+// useNonce records the nonce, it return false if the nonce was used.
+func (t *signedTokenParser) useNonce(nonce string, expiry time.Time, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.After(t.nextPurge) {
+		for n, e := range t.nonces {
+			if now.After(e) {
+				delete(t.nonces, n)
+			}
+		}
+		t.nextPurge = now.Add(time.Minute)
+	}
+	if _, ok := t.nonces[nonce]; ok {
+		return false
+	}
+	t.nonces[nonce] = expiry
+	return true
+}
+
+// NewSignedTokenParserPlugin return a "Signed" type token parser plugin.
+// The token must be signed by HMAC-SHA256 with the key, and it carries the
+// server application's address, issued-at, expiry and a nonce. The expired,
+// tampered and replayed tokens are rejected.
+func NewSignedTokenParserPlugin(key string) *signedTokenParser {
+	return &signedTokenParser{key: []byte(key), nonces: map[string]time.Time{}}
+}
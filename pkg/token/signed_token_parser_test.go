@@ -0,0 +1,69 @@
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signPayload signs the payload like TokenSigner, so that the tests can make the invalid payloads.
+func signPayload(t *testing.T, key string, payload signedPayload) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature([]byte(key), encoded))
+}
+
+func TestSignedTokenParser(t *testing.T) {
+	const key = "shared-key"
+	now := time.Now()
+	valid := func(nonce string) signedPayload {
+		return signedPayload{Target: "tcp:10.0.0.1:22", IssuedAt: now.Unix(), Expiry: now.Add(time.Minute).Unix(), Nonce: nonce}
+	}
+	signed := signPayload(t, key, valid("n1"))
+	encoded, sig, _ := strings.Cut(signed, ".")
+	tampered, _ := json.Marshal(signedPayload{Target: "tcp:169.254.169.254:80", IssuedAt: now.Unix(), Expiry: now.Add(time.Minute).Unix(), Nonce: "n2"})
+
+	parser := NewSignedTokenParserPlugin(key)
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", signed, ""},
+		{"replayed", signed, "the token is replayed"},
+		{"signed by the signer", mustSign(t, NewTokenSigner(key, time.Minute), "tcp:10.0.0.1:22"), ""},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString(tampered) + "." + sig, "the token's signature is invalid"},
+		{"tampered signature", encoded + "." + base64.RawURLEncoding.EncodeToString([]byte("guess")), "the token's signature is invalid"},
+		{"another key", signPayload(t, "another-key", valid("n3")), "the token's signature is invalid"},
+		{"malformed", "unix:/run/app", "the token is malformed"},
+		{"expired", signPayload(t, key, signedPayload{Target: "tcp:10.0.0.1:22", IssuedAt: now.Add(-2 * time.Minute).Unix(), Expiry: now.Add(-time.Minute).Unix(), Nonce: "n4"}), "the token is expired"},
+		{"expired within clock skew", signPayload(t, key, signedPayload{Target: "tcp:10.0.0.1:22", IssuedAt: now.Add(-time.Minute).Unix(), Expiry: now.Add(-10 * time.Second).Unix(), Nonce: "n5"}), ""},
+		{"issued in the future", signPayload(t, key, signedPayload{Target: "tcp:10.0.0.1:22", IssuedAt: now.Add(time.Minute).Unix(), Expiry: now.Add(2 * time.Minute).Unix(), Nonce: "n6"}), "the token is issued in the future"},
+		{"missing nonce", signPayload(t, key, valid("")), "the token's nonce is missing"},
+	}
+	for _, tt := range tests {
+		target, err := parser.ParseToken(tt.token)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if target != "tcp:10.0.0.1:22" {
+				t.Errorf("%s: got target %s", tt.name, target)
+			}
+		} else if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func mustSign(t *testing.T, signer *TokenSigner, target string) string {
+	token, err := signer.Sign(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,85 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// The payload of a "Signed" token
+type signedPayload struct {
+	// The server application's address, e.g. tcp:127.0.0.1:22
+	Target   string `json:"target"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	// A random string, used to detect the replayed tokens
+	Nonce string `json:"nonce"`
+}
+
+// TokenSigner signs the tokens with the shared HMAC key, the signed tokens can
+// be parsed by the "Signed" token parser plugin.
+type TokenSigner struct {
+	key []byte
+	// The signed token expires after the duration
+	ttl time.Duration
+}
+
+// NewTokenSigner return a token signer, the key must be same as the key of
+// "Signed" token parser plugin in server endpoint.
+func NewTokenSigner(key string, ttl time.Duration) *TokenSigner {
+	return &TokenSigner{key: []byte(key), ttl: ttl}
+}
+
+// Sign makes a signed token for the target. The token is like
+// base64url(payload) + "." + base64url(HMAC-SHA256(base64url(payload))).
+func (s *TokenSigner) Sign(target string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	payload, err := json.Marshal(signedPayload{
+		Target:   target,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(s.ttl).Unix(),
+		Nonce:    hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature(s.key, encoded)), nil
+}
+
+func signature(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+type signedTokenSourcePlugin struct {
+	source TokenSourcePlugin
+	signer *TokenSigner
+}
+
+func (t signedTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t signedTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	target, err := GetToken(t.source, ctx)
+	if err != nil {
+		return "", err
+	}
+	return t.signer.Sign(target)
+}
+
+// NewSignedTokenSourcePlugin wraps the source, the token returned by the source
+// is used as the target of the signed token.
+func NewSignedTokenSourcePlugin(source TokenSourcePlugin, signer *TokenSigner) signedTokenSourcePlugin {
+	return signedTokenSourcePlugin{source: source, signer: signer}
+}
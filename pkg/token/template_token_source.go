@@ -0,0 +1,62 @@
+package token
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The functions which can be used in the template of "Template" token source plugin
+var templateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	// host returns the host of an address like host:port
+	"host": func(addr string) string {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		return host
+	},
+	// port returns the port of an address like host:port, it is 0 if the address has no port
+	"port": func(addr string) int {
+		_, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		return p
+	},
+}
+
+type templateTokenSourcePlugin struct {
+	template *template.Template
+}
+
+func (t *templateTokenSourcePlugin) GetToken(addr string) (string, error) {
+	return t.GetTokenContext(&ConnContext{SourceAddr: addr})
+}
+
+func (t *templateTokenSourcePlugin) GetTokenContext(ctx *ConnContext) (string, error) {
+	var buf strings.Builder
+	if err := t.template.Execute(&buf, ctx); err != nil {
+		return "", fmt.Errorf("failed to execute the token template: %w", err)
+	}
+	token := strings.TrimSpace(buf.String())
+	if token == "" {
+		return "", fmt.Errorf("the token template returned an empty token")
+	}
+	return token, nil
+}
+
+// NewTemplateTokenSourcePlugin return a "Template" type token source plugin.
+// The tokenSource is a Go template, it is executed with the ConnContext of the
+// client application's connection, e.g. tcp:10.0.0.5:{{add 2200 (sub .ListenPort 6500)}}
+// maps the local ports 6500-6599 onto the remote ports 2200-2299. The functions
+// add, sub, host and port can be used in the template.
+func NewTemplateTokenSourcePlugin(tokenSource string) (*templateTokenSourcePlugin, error) {
+	tmpl, err := template.New("token").Funcs(templateFuncs).Option("missingkey=error").Parse(tokenSource)
+	if err != nil {
+		return nil, fmt.Errorf("the token template is invalid: %w", err)
+	}
+	return &templateTokenSourcePlugin{template: tmpl}, nil
+}
@@ -0,0 +1,41 @@
+package token
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kungze/quic-tun/pkg/log"
+)
+
+// watchFile calls reload once the file changes. The directory is watched instead
+// of the file, so that the file replaced by rename is also detected.
+func watchFile(filePath string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(filePath)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filePath && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorw("Failed to watch the file.", "file", filePath, "error", err.Error())
+			}
+		}
+	}()
+	return nil
+}
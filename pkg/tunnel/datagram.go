@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The length of the flow ID, every QUIC datagram is prefixed with the flow ID
+const flowIDLength = 8
+
+// The number of datagrams can be cached for a flow, the exceeded datagrams are
+// dropped just like the UDP protocol.
+const flowQueueLength = 128
+
+// The datagrams of a unknown flow are cached for a while, because the client
+// endpoint may send datagrams before server endpoint registers the flow.
+const (
+	pendingFlowTimeout = 5 * time.Second
+	maxPendingFlows    = 1024
+)
+
+type pendingFlow struct {
+	createdAt time.Time
+	datagrams [][]byte
+}
+
+// DatagramMux dispatches the QUIC datagrams of a session to the UDP flows.
+// A flow is identified by the ID of the QUIC stream which is used to handshake,
+// so both endpoints know the flow ID without extra negotiation.
+type DatagramMux struct {
+	session quic.Session
+	mu      sync.Mutex
+	flows   map[quic.StreamID]chan []byte
+	pending map[quic.StreamID]*pendingFlow
+}
+
+// All datagram muxes, the key is quic.Session
+var datagramMuxes sync.Map
+
+// GetDatagramMux return the datagram mux of the session, the mux is created at the first time.
+func GetDatagramMux(session quic.Session) *DatagramMux {
+	if m, ok := datagramMuxes.Load(session); ok {
+		return m.(*DatagramMux)
+	}
+	m, loaded := datagramMuxes.LoadOrStore(session, &DatagramMux{
+		session: session,
+		flows:   map[quic.StreamID]chan []byte{},
+		pending: map[quic.StreamID]*pendingFlow{},
+	})
+	mux := m.(*DatagramMux)
+	if !loaded {
+		go mux.receive()
+	}
+	return mux
+}
+
+func (m *DatagramMux) receive() {
+	defer datagramMuxes.Delete(m.session)
+	for {
+		msg, err := m.session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		if len(msg) < flowIDLength {
+			continue
+		}
+		id := quic.StreamID(binary.BigEndian.Uint64(msg[:flowIDLength]))
+		m.mu.Lock()
+		if queue, ok := m.flows[id]; ok {
+			select {
+			case queue <- msg[flowIDLength:]:
+			default:
+			}
+		} else {
+			m.cachePending(id, msg[flowIDLength:])
+		}
+		m.mu.Unlock()
+	}
+}
+
+// cachePending must be called with m.mu held
+func (m *DatagramMux) cachePending(id quic.StreamID, data []byte) {
+	now := time.Now()
+	flow, ok := m.pending[id]
+	if !ok {
+		for pid, p := range m.pending {
+			if now.Sub(p.createdAt) > pendingFlowTimeout {
+				delete(m.pending, pid)
+			}
+		}
+		if len(m.pending) >= maxPendingFlows {
+			return
+		}
+		flow = &pendingFlow{createdAt: now}
+		m.pending[id] = flow
+	}
+	if len(flow.datagrams) < flowQueueLength {
+		flow.datagrams = append(flow.datagrams, data)
+	}
+}
+
+func (m *DatagramMux) register(id quic.StreamID) <-chan []byte {
+	queue := make(chan []byte, flowQueueLength)
+	m.mu.Lock()
+	if flow, ok := m.pending[id]; ok {
+		for _, data := range flow.datagrams {
+			queue <- data
+		}
+		delete(m.pending, id)
+	}
+	m.flows[id] = queue
+	m.mu.Unlock()
+	return queue
+}
+
+func (m *DatagramMux) unregister(id quic.StreamID) {
+	m.mu.Lock()
+	delete(m.flows, id)
+	m.mu.Unlock()
+}
+
+func (m *DatagramMux) send(id quic.StreamID, payload []byte) error {
+	msg := make([]byte, flowIDLength+len(payload))
+	binary.BigEndian.PutUint64(msg, uint64(id))
+	copy(msg[flowIDLength:], payload)
+	return m.session.SendMessage(msg)
+}
+
+// EstablishDatagram forwards the UDP datagrams of a flow over the QUIC datagrams
+// of the session. The appRecv delivers the datagrams which are received from the
+// UDP application, the appSend sends a datagram to the UDP application. The flow
+// is finished once it is idle for idleTimeout or the handshake stream is closed.
+func (t *Tunnel) EstablishDatagram(ctx context.Context, session quic.Session, appRecv <-chan []byte, appSend func([]byte) error, idleTimeout time.Duration) {
+	logger := log.FromContext(ctx)
+	t.Network = "udp"
+	t.fillProperties(ctx)
+	mux := GetDatagramMux(session)
+	quicRecv := mux.register(t.StreamID)
+	defer mux.unregister(t.StreamID)
+	// The handshake stream is kept open during the flow's lifetime, either
+	// endpoint closes it means the flow is finished.
+	streamClosed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, *t.Stream)
+		close(streamClosed)
+	}()
+	DataStore.Store(t.Uuid, *t)
+	logger.Info("Tunnel established successful")
+	if t.Hooks != nil && t.Hooks.OnEstablished != nil {
+		t.Hooks.OnEstablished(*t)
+	}
+
+	var appTotal, appPreTotal, quicTotal, quicPreTotal int64
+	lastActive := time.Now()
+	timeTick := time.NewTicker(1 * time.Second)
+	defer timeTick.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-streamClosed:
+			break loop
+		case data := <-appRecv:
+			if err := mux.send(t.StreamID, data); err != nil {
+				logger.Debugw("Failed to send QUIC datagram, drop it.", "error", err.Error(), "length", len(data))
+				continue
+			}
+			appTotal += int64(len(data))
+			lastActive = time.Now()
+		case data := <-quicRecv:
+			if err := appSend(data); err != nil {
+				logger.Errorw("Failed to send datagram to UDP application.", "error", err.Error())
+				break loop
+			}
+			quicTotal += int64(len(data))
+			lastActive = time.Now()
+		case <-timeTick.C:
+			if time.Since(lastActive) > idleTimeout {
+				logger.Info("The UDP flow is idle, close it.")
+				break loop
+			}
+			// In client endpoint, the application is client application; In server endpoint, them is inverse.
+			if t.connIsClientApp() {
+				t.ClientTotalBytes, t.ServerTotalBytes = appTotal, quicTotal
+				t.ClientSendRate = fmt.Sprintf("%.2f kB/s", float64(appTotal-appPreTotal)/1024.0)
+				t.ServerSendRate = fmt.Sprintf("%.2f kB/s", float64(quicTotal-quicPreTotal)/1024.0)
+			} else {
+				t.ServerTotalBytes, t.ClientTotalBytes = appTotal, quicTotal
+				t.ServerSendRate = fmt.Sprintf("%.2f kB/s", float64(appTotal-appPreTotal)/1024.0)
+				t.ClientSendRate = fmt.Sprintf("%.2f kB/s", float64(quicTotal-quicPreTotal)/1024.0)
+			}
+			appPreTotal, quicPreTotal = appTotal, quicTotal
+			DataStore.Store(t.Uuid, *t)
+		}
+	}
+	(*t.Stream).CancelRead(0)
+	(*t.Stream).Close()
+	DataStore.Delete(t.Uuid)
+	logger.Info("Tunnel closed")
+	if t.Hooks != nil && t.Hooks.OnClosed != nil {
+		t.Hooks.OnClosed(*t)
+	}
+}
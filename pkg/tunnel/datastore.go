@@ -8,10 +8,10 @@ type tunnelDataStore struct {
 	sync.Map
 }
 
-func (t *tunnelDataStore) LoadAll() []tunnel {
-	var tunnels []tunnel
+func (t *tunnelDataStore) LoadAll() []Tunnel {
+	var tunnels []Tunnel
 	t.Range(func(key, value any) bool {
-		tunnels = append(tunnels, value.(tunnel))
+		tunnels = append(tunnels, value.(Tunnel))
 		return true
 	})
 	return tunnels
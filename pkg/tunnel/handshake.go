@@ -2,13 +2,66 @@ package tunnel
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 
+	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/lucas-clemente/quic-go"
 )
 
+// The versions of the handshake protocol. The v1 handshake is a NUL padded token
+// with fixed length and a single ack byte. The v2 handshake is framed:
+//
+//	request: 0xFF | version(1) | capabilities(4) | token length(4) | token |
+//	         metadata count(2) | [key length(2) | key | value length(2) | value]...
+//	ack:     code(1) | capabilities(4) | message length(2) | message
+//
+// The integers are big endian. Server endpoint detects the version by the first
+// byte, a v1 token never starts with 0xFF, so it accepts both versions.
+const (
+	HandshakeV1 = 1
+	HandshakeV2 = 2
+	// The latest version, client endpoint uses it by default
+	HandshakeLatest = HandshakeV2
+)
+
+// The first byte of the v2 and later handshake requests
+const handshakeMagic = 0xFF
+
+// The capability flags negotiated by the v2 handshake, client endpoint sends the
+// capabilities it wants, server endpoint acks the ones it supports among them.
+const (
+	// The UDP flows are forwarded by QUIC datagrams
+	CapabilityDatagram uint32 = 1 << iota
+	// The reverse forward rules can be registered
+	CapabilityReverse
+	// The handshake is a health probe, server endpoint acks it without parsing
+	// the token and doesn't establish a tunnel.
+	CapabilityProbe
+)
+
+// The keys of the metadata sent by client endpoint in the v2 handshake
+const (
+	MetadataClientAppAddr = "client-app-addr"
+	MetadataForwardRule   = "forward-rule"
+)
+
+// The limits of the v2 handshake, the longer message of ack is truncated, the
+// other longer data is refused.
+const (
+	maxMetadataCount    = 32
+	maxHandshakeString  = 1024
+	maxHandshakeMessage = 1024
+)
+
+// ErrUnsupportedVersion is returned by ReceiveToken if the handshake version of client endpoint isn't supported.
+var ErrUnsupportedVersion = errors.New("the handshake version isn't supported")
+
 type handshakefunc func(context.Context, *quic.Stream, *HandshakeHelper) (bool, *net.Conn)
 
 type HandshakeHelper struct {
@@ -25,10 +78,29 @@ type HandshakeHelper struct {
 	// server endpoint, this store the 'token'; In client endpoint,
 	// this store the ack message.
 	ReceiveData string
+	// The subject of the token, it is set by server endpoint if the token
+	// parser plugin provides it.
+	Subject string
+	// The backend which server endpoint connects, if the token resolves to a
+	// backend group, it is the chosen one. It is set by server endpoint.
+	Backend string
+	// The version of the handshake protocol, zero means HandshakeV1. Client
+	// endpoint sets it before sending the token, server endpoint detects it.
+	Version int
+	// The capabilities sent by client endpoint, they are replaced by the
+	// negotiated ones once the ack is sent or received.
+	Capabilities uint32
+	// The metadata sent by client endpoint, only the v2 handshake carries it.
+	Metadata map[string]string
+	// The message of the ack, only the v2 handshake carries it.
+	Message string
+	// The identity of client endpoint's certificate, it is set by server endpoint.
+	PeerIdentity *token.PeerIdentity
 }
 
 func (h *HandshakeHelper) Write(b []byte) (int, error) {
-	h.ReceiveData = strings.ReplaceAll(string(b), "\x00", "")
+	// The data may be received in several pieces
+	h.ReceiveData += strings.ReplaceAll(string(b), "\x00", "")
 	return len(b), nil
 }
 
@@ -47,6 +119,167 @@ func (h *HandshakeHelper) SetSendData(data []byte) {
 	copy(h.SendData, data)
 }
 
+// SendToken sends the token to server endpoint. In v1, the token is padded to
+// the length of SendData; in v2, it is sent with the capabilities and metadata.
+// The token is never truncated, the too long token is an error.
+func (h *HandshakeHelper) SendToken(w io.Writer, tok string) error {
+	if h.Version < HandshakeV2 {
+		if len(tok) > len(h.SendData) {
+			return fmt.Errorf("the token is too long, its length exceeds %d", len(h.SendData))
+		}
+		h.SetSendData([]byte(tok))
+		_, err := io.CopyN(w, h, int64(len(h.SendData)))
+		return err
+	}
+	if len(tok) > constants.MaxTokenLength {
+		return fmt.Errorf("the token is too long, its length exceeds %d", constants.MaxTokenLength)
+	}
+	if len(h.Metadata) > maxMetadataCount {
+		return fmt.Errorf("the metadata has more than %d entries", maxMetadataCount)
+	}
+	buf := make([]byte, 0, 12+len(tok))
+	buf = append(buf, handshakeMagic, byte(h.Version))
+	buf = appendUint32(buf, h.Capabilities)
+	buf = appendUint32(buf, uint32(len(tok)))
+	buf = append(buf, tok...)
+	buf = appendUint16(buf, uint16(len(h.Metadata)))
+	for k, v := range h.Metadata {
+		if len(k) > maxHandshakeString || len(v) > maxHandshakeString {
+			return fmt.Errorf("the metadata %s is too long, its length exceeds %d", k, maxHandshakeString)
+		}
+		buf = appendString16(buf, k)
+		buf = appendString16(buf, v)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReceiveToken receives the token from client endpoint, the version is detected
+// by the first byte. The v1 token is read with the fixed v1Length.
+func (h *HandshakeHelper) ReceiveToken(r io.Reader, v1Length int64) error {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return err
+	}
+	if first[0] != handshakeMagic {
+		h.Version = HandshakeV1
+		_, _ = h.Write(first[:])
+		_, err := io.CopyN(h, r, v1Length-1)
+		return err
+	}
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	h.Version = int(header[0])
+	if h.Version != HandshakeV2 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	h.Capabilities = binary.BigEndian.Uint32(header[1:5])
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > constants.MaxTokenLength {
+		return fmt.Errorf("the token is too long, its length %d exceeds %d", length, constants.MaxTokenLength)
+	}
+	tok := make([]byte, length)
+	if _, err := io.ReadFull(r, tok); err != nil {
+		return err
+	}
+	var count [2]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint16(count[:])
+	if n > maxMetadataCount {
+		return fmt.Errorf("the metadata has more than %d entries", maxMetadataCount)
+	}
+	metadata := make(map[string]string, n)
+	for i := 0; i < int(n); i++ {
+		k, err := readString16(r, maxHandshakeString)
+		if err != nil {
+			return err
+		}
+		v, err := readString16(r, maxHandshakeString)
+		if err != nil {
+			return err
+		}
+		metadata[k] = v
+	}
+	h.ReceiveData = string(tok)
+	h.Metadata = metadata
+	return nil
+}
+
+// SendAck sends the ack to client endpoint in the version of the handshake, the
+// v1 ack is only the code. The capabilities of the v2 ack are h.Capabilities.
+func (h *HandshakeHelper) SendAck(w io.Writer, code byte, message string) error {
+	if h.Version < HandshakeV2 {
+		_, err := w.Write([]byte{code})
+		return err
+	}
+	if len(message) > maxHandshakeMessage {
+		message = message[:maxHandshakeMessage]
+	}
+	buf := make([]byte, 0, 7+len(message))
+	buf = append(buf, code)
+	buf = appendUint32(buf, h.Capabilities)
+	buf = appendString16(buf, message)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReceiveAck receives the ack from server endpoint in the version of the handshake,
+// the code is stored in ReceiveData, the message and capabilities are stored too.
+func (h *HandshakeHelper) ReceiveAck(r io.Reader) (byte, error) {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return 0, err
+	}
+	h.ReceiveData = string(code[:])
+	if h.Version < HandshakeV2 {
+		return code[0], nil
+	}
+	var caps [4]byte
+	if _, err := io.ReadFull(r, caps[:]); err != nil {
+		return 0, err
+	}
+	h.Capabilities = binary.BigEndian.Uint32(caps[:])
+	message, err := readString16(r, maxHandshakeMessage)
+	if err != nil {
+		return 0, err
+	}
+	h.Message = message
+	return code[0], nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendString16(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func readString16(r io.Reader, limit int) (string, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n > limit {
+		return "", fmt.Errorf("the handshake string is too long, its length %d exceeds %d", n, limit)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 func NewHandshakeHelper(length int, hsf handshakefunc) HandshakeHelper {
 	// Make a fixed length data, we wish that the message's length is
 	// explicit and constant in handshake stage.
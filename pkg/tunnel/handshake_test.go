@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+)
+
+// tokenFrame makes a v2 request with the token length, the token and the raw metadata.
+func tokenFrame(version byte, length uint32, tok string, metadata []byte) []byte {
+	buf := []byte{handshakeMagic, version}
+	buf = appendUint32(buf, CapabilityDatagram)
+	buf = appendUint32(buf, length)
+	buf = append(buf, tok...)
+	return append(buf, metadata...)
+}
+
+func TestReceiveToken(t *testing.T) {
+	metadata := appendUint16(nil, 1)
+	metadata = appendString16(metadata, MetadataForwardRule)
+	metadata = appendString16(metadata, "ssh")
+	long := strings.Repeat("a", maxHandshakeString+1)
+	tests := []struct {
+		name  string
+		data  []byte
+		token string
+		err   string
+	}{
+		{"v1", append([]byte("tcp:10.0.0.1:22"), make([]byte, constants.TokenLength-15)...), "tcp:10.0.0.1:22", ""},
+		{"v1 truncated", []byte("tcp:10.0.0.1:22"), "", "EOF"},
+		{"v2", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", metadata), "tcp:10.0.0.1:22", ""},
+		{"v2 without metadata", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", []byte{0, 0}), "tcp:10.0.0.1:22", ""},
+		{"unsupported version", tokenFrame(3, 15, "tcp:10.0.0.1:22", []byte{0, 0}), "", ErrUnsupportedVersion.Error() + ": 3"},
+		{"truncated header", []byte{handshakeMagic, HandshakeV2, 0, 0}, "", io.ErrUnexpectedEOF.Error()},
+		{"oversized token", tokenFrame(HandshakeV2, constants.MaxTokenLength+1, "", nil), "", "the token is too long, its length 16385 exceeds 16384"},
+		{"truncated token", tokenFrame(HandshakeV2, 100, "tcp:10.0.0.1:22", nil), "", io.ErrUnexpectedEOF.Error()},
+		{"missing metadata count", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", nil), "", io.EOF.Error()},
+		{"too many metadata", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", appendUint16(nil, maxMetadataCount+1)), "", "the metadata has more than 32 entries"},
+		{"oversized metadata", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", appendString16(appendUint16(nil, 1), long)), "", "the handshake string is too long, its length 1025 exceeds 1024"},
+		{"truncated metadata", tokenFrame(HandshakeV2, 15, "tcp:10.0.0.1:22", metadata[:len(metadata)-2]), "", io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		hsh := NewHandshakeHelper(constants.AckMsgLength, nil)
+		err := hsh.ReceiveToken(bytes.NewReader(tt.data), constants.TokenLength)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if hsh.ReceiveData != tt.token {
+			t.Errorf("%s: got token %q, want %q", tt.name, hsh.ReceiveData, tt.token)
+		}
+	}
+}
+
+func TestSendReceiveToken(t *testing.T) {
+	for _, version := range []int{HandshakeV1, HandshakeV2} {
+		client := NewHandshakeHelper(constants.TokenLength, nil)
+		client.Version = version
+		client.Capabilities = CapabilityDatagram | CapabilityReverse
+		client.Metadata = map[string]string{MetadataClientAppAddr: "127.0.0.1:50000", MetadataForwardRule: "ssh"}
+		var buf bytes.Buffer
+		if err := client.SendToken(&buf, "tcp:10.0.0.1:22"); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		server := NewHandshakeHelper(constants.AckMsgLength, nil)
+		if err := server.ReceiveToken(&buf, constants.TokenLength); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if server.Version != version || server.ReceiveData != "tcp:10.0.0.1:22" {
+			t.Errorf("v%d: got version %d and token %q", version, server.Version, server.ReceiveData)
+		}
+		if version == HandshakeV2 && (server.Capabilities != client.Capabilities || server.Metadata[MetadataForwardRule] != "ssh") {
+			t.Errorf("v%d: got capabilities %d and metadata %v", version, server.Capabilities, server.Metadata)
+		}
+	}
+	// The token is never truncated
+	hsh := NewHandshakeHelper(constants.TokenLength, nil)
+	if err := hsh.SendToken(io.Discard, strings.Repeat("a", constants.TokenLength+1)); err == nil {
+		t.Error("v1: the too long token is sent")
+	}
+	hsh.Version = HandshakeV2
+	if err := hsh.SendToken(io.Discard, strings.Repeat("a", constants.MaxTokenLength+1)); err == nil {
+		t.Error("v2: the too long token is sent")
+	}
+}
+
+func TestReceiveAck(t *testing.T) {
+	ack := func(code byte, message []byte) []byte {
+		return append(appendUint32([]byte{code}, CapabilityDatagram), message...)
+	}
+	tests := []struct {
+		name    string
+		version int
+		data    []byte
+		code    byte
+		message string
+		err     error
+	}{
+		{"v1", HandshakeV1, []byte{constants.HandshakeSuccess}, constants.HandshakeSuccess, "", nil},
+		{"v1 empty", HandshakeV1, nil, 0, "", io.EOF},
+		{"v2", HandshakeV2, ack(constants.ParseTokenError, appendString16(nil, "the JWT is expired")), constants.ParseTokenError, "the JWT is expired", nil},
+		{"v2 truncated capabilities", HandshakeV2, []byte{constants.HandshakeSuccess, 0, 0}, 0, "", io.ErrUnexpectedEOF},
+		{"v2 missing message", HandshakeV2, ack(constants.HandshakeSuccess, nil), 0, "", io.EOF},
+		{"v2 truncated message", HandshakeV2, ack(constants.ParseTokenError, appendString16(nil, "the JWT is expired")[:10]), 0, "", io.ErrUnexpectedEOF},
+		{"v2 oversized message", HandshakeV2, ack(constants.ParseTokenError, appendString16(nil, strings.Repeat("a", maxHandshakeMessage+1))), 0, "", errors.New("the handshake string is too long, its length 1025 exceeds 1024")},
+	}
+	for _, tt := range tests {
+		hsh := NewHandshakeHelper(constants.TokenLength, nil)
+		hsh.Version = tt.version
+		code, err := hsh.ReceiveAck(bytes.NewReader(tt.data))
+		if tt.err != nil {
+			if err == nil || err.Error() != tt.err.Error() {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if code != tt.code || hsh.Message != tt.message {
+			t.Errorf("%s: got code %d and message %q", tt.name, code, hsh.Message)
+		}
+	}
+	// The too long message is truncated by the sender, so the receiver accepts it.
+	sender := NewHandshakeHelper(constants.AckMsgLength, nil)
+	sender.Version = HandshakeV2
+	var buf bytes.Buffer
+	if err := sender.SendAck(&buf, constants.CannotConnServer, strings.Repeat("a", maxHandshakeMessage+1)); err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewHandshakeHelper(constants.TokenLength, nil)
+	receiver.Version = HandshakeV2
+	if _, err := receiver.ReceiveAck(&buf); err != nil || len(receiver.Message) != maxHandshakeMessage {
+		t.Errorf("got message length %d and error %v", len(receiver.Message), err)
+	}
+}
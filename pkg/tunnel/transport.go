@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kungze/quic-tun/pkg/options"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// NewQuicConfig returns the QUIC config of the transport options.
+func NewQuicConfig(t *options.TransportOptions) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:           t.HandshakeIdleTimeout,
+		MaxIdleTimeout:                 t.MaxIdleTimeout,
+		KeepAlive:                      t.KeepAlive,
+		InitialStreamReceiveWindow:     t.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         t.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: t.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     t.MaxConnectionReceiveWindow,
+		MaxIncomingStreams:             t.MaxIncomingStreams,
+	}
+}
+
+// SetSocketBuffers sets the read and write buffer sizes of the UDP socket which
+// QUIC runs on, the zero sizes are left unchanged. quic-go sets the read buffer
+// to 2 MB once it starts to use the socket, so it must be called after the
+// socket is passed to quic.Listen or quic.DialContext.
+func SetSocketBuffers(conn *net.UDPConn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			return fmt.Errorf("failed to set the read buffer size of UDP socket: %w", err)
+		}
+	}
+	if writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+			return fmt.Errorf("failed to set the write buffer size of UDP socket: %w", err)
+		}
+	}
+	return nil
+}
@@ -13,19 +13,36 @@ import (
 	"github.com/kungze/quic-tun/pkg/classifier"
 	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/lucas-clemente/quic-go"
 )
 
-type tunnel struct {
+// Hooks are the callbacks which are called on the lifecycle events of a tunnel.
+// The callbacks are called synchronously, they should return quickly.
+type Hooks struct {
+	// Called after the tunnel is established
+	OnEstablished func(Tunnel)
+	// Called after the tunnel is closed
+	OnClosed func(Tunnel)
+}
+
+// Tunnel forwards the traffic between a QUIC stream and a TCP/UNIX socket connection.
+type Tunnel struct {
 	Stream             *quic.Stream     `json:"-"`
 	Conn               *net.Conn        `json:"-"`
 	Hsh                *HandshakeHelper `json:"-"`
+	Hooks              *Hooks           `json:"-"`
 	Uuid               uuid.UUID        `json:"uuid"`
 	StreamID           quic.StreamID    `json:"streamId"`
 	Endpoint           string           `json:"endpoint"`
 	ClientAppAddr      string           `json:"clientAppAddr,omitempty"`
 	ServerAppAddr      string           `json:"serverAppAddr,omitempty"`
+	Backend            string           `json:"backend,omitempty"`
 	RemoteEndpointAddr string           `json:"remoteEndpointAddr"`
+	ForwardRule        string           `json:"forwardRule,omitempty"`
+	Subject            string           `json:"subject,omitempty"`
+	Reverse            bool             `json:"reverse,omitempty"`
+	Network            string           `json:"network"`
 	CreatedAt          string           `json:"createdAt"`
 	ServerTotalBytes   int64            `json:"serverTotalBytes"`
 	ClientTotalBytes   int64            `json:"clientTotalBytes"`
@@ -33,6 +50,10 @@ type tunnel struct {
 	ClientSendRate     string           `json:"clientSendRate"`
 	Protocol           string           `json:"protocol"`
 	ProtocolProperties any              `json:"protocolProperties"`
+	// The version of the handshake protocol, it is empty for the reverse tunnels
+	HandshakeVersion int `json:"handshakeVersion,omitempty"`
+	// The identity of client endpoint's certificate, it is only filled by server endpoint.
+	PeerIdentity *token.PeerIdentity `json:"peerIdentity,omitempty"`
 	// Used to cache the header data from QUIC stream
 	streamCache *classifier.HeaderCache
 	// Used to cache the header data from TCP/UNIX socket connection
@@ -41,7 +62,7 @@ type tunnel struct {
 
 // Before the tunnel establishment, client endpoint and server endpoint need to
 // process handshake steps (client endpoint send token, server endpont parse and verify token)
-func (t *tunnel) HandShake(ctx context.Context) bool {
+func (t *Tunnel) HandShake(ctx context.Context) bool {
 	res, conn := t.Hsh.Handshakefunc(ctx, t.Stream, t.Hsh)
 	if conn != nil {
 		t.Conn = conn
@@ -49,7 +70,7 @@ func (t *tunnel) HandShake(ctx context.Context) bool {
 	return res
 }
 
-func (t *tunnel) countTraffic(ctx context.Context, stream2conn, conn2stream <-chan int) {
+func (t *Tunnel) countTraffic(ctx context.Context, stream2conn, conn2stream <-chan int) {
 	var s2cTotal, s2cPreTotal, c2sTotal, c2sPreTotal int64
 	var s2cRate, c2sRate float64
 	var tmp int
@@ -68,13 +89,12 @@ func (t *tunnel) countTraffic(ctx context.Context, stream2conn, conn2stream <-ch
 			c2sRate = float64((c2sTotal - c2sPreTotal)) / 1024.0
 			c2sPreTotal = c2sTotal
 		}
-		if t.Endpoint == constants.ClientEndpoint {
+		if t.connIsClientApp() {
 			t.ServerTotalBytes = s2cTotal
 			t.ServerSendRate = fmt.Sprintf("%.2f kB/s", s2cRate)
 			t.ClientTotalBytes = c2sTotal
 			t.ClientSendRate = fmt.Sprintf("%.2f kB/s", c2sRate)
-		}
-		if t.Endpoint == constants.ServerEndpoint {
+		} else {
 			t.ServerTotalBytes = c2sTotal
 			t.ServerSendRate = fmt.Sprintf("%.2f kB/s", c2sRate)
 			t.ClientTotalBytes = s2cTotal
@@ -84,7 +104,7 @@ func (t *tunnel) countTraffic(ctx context.Context, stream2conn, conn2stream <-ch
 	}
 }
 
-func (t *tunnel) Establish(ctx context.Context) {
+func (t *Tunnel) Establish(ctx context.Context) {
 	logger := log.FromContext(ctx)
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -103,12 +123,18 @@ func (t *tunnel) Establish(ctx context.Context) {
 	defer cancle()
 	go t.countTraffic(ctx, steam2conn, conn2stream)
 	go t.analyze(ctx)
+	if t.Hooks != nil && t.Hooks.OnEstablished != nil {
+		t.Hooks.OnEstablished(*t)
+	}
 	wg.Wait()
 	DataStore.Delete(t.Uuid)
 	logger.Info("Tunnel closed")
+	if t.Hooks != nil && t.Hooks.OnClosed != nil {
+		t.Hooks.OnClosed(*t)
+	}
 }
 
-func (t *tunnel) analyze(ctx context.Context) {
+func (t *Tunnel) analyze(ctx context.Context) {
 	discrs := classifier.LoadDiscriminators()
 	var res int
 	// We don't know that the number and time the traffic data pass through the tunnel.
@@ -126,7 +152,7 @@ func (t *tunnel) analyze(ctx context.Context) {
 			for protocol, discr := range discrs {
 				//  In client endpoint, connCache store client application header data, streamCache
 				// store server application header data; In server endpoint, them is inverse.
-				if t.Endpoint == constants.ClientEndpoint {
+				if t.connIsClientApp() {
 					res = discr.AnalyzeHeader(ctx, &t.connCache.Header, &t.streamCache.Header)
 				} else {
 					res = discr.AnalyzeHeader(ctx, &t.streamCache.Header, &t.connCache.Header)
@@ -151,19 +177,35 @@ func (t *tunnel) analyze(ctx context.Context) {
 	}
 }
 
-func (t *tunnel) fillProperties(ctx context.Context) {
+// connIsClientApp reports whether the Conn is connected to the client application.
+// In client endpoint, the Conn is client application's connection; In server
+// endpoint, it is server application's connection. The reverse tunnels are inverse.
+func (t *Tunnel) connIsClientApp() bool {
+	return (t.Endpoint == constants.ClientEndpoint) != t.Reverse
+}
+
+func (t *Tunnel) fillProperties(ctx context.Context) {
 	t.StreamID = (*t.Stream).StreamID()
-	if t.Endpoint == constants.ClientEndpoint {
-		t.ClientAppAddr = (*t.Conn).RemoteAddr().String()
+	if t.Hsh != nil {
+		t.HandshakeVersion = t.Hsh.Version
 	}
-	if t.Endpoint == constants.ServerEndpoint {
-		t.ServerAppAddr = (*t.Conn).RemoteAddr().String()
+	// The client endpoint's UDP flows haven't a dedicated connection, the
+	// client application address is filled by the caller.
+	if t.Conn != nil {
+		if t.Network == "" {
+			t.Network = (*t.Conn).RemoteAddr().Network()
+		}
+		if t.connIsClientApp() {
+			t.ClientAppAddr = (*t.Conn).RemoteAddr().String()
+		} else {
+			t.ServerAppAddr = (*t.Conn).RemoteAddr().String()
+		}
 	}
 	t.RemoteEndpointAddr = fmt.Sprint(ctx.Value(constants.CtxRemoteEndpointAddr))
 	t.CreatedAt = time.Now().String()
 }
 
-func (t *tunnel) stream2Conn(logger log.Logger, wg *sync.WaitGroup, forwardNumChan chan<- int) {
+func (t *Tunnel) stream2Conn(logger log.Logger, wg *sync.WaitGroup, forwardNumChan chan<- int) {
 	defer func() {
 		(*t.Stream).Close()
 		(*t.Conn).Close()
@@ -179,7 +221,7 @@ func (t *tunnel) stream2Conn(logger log.Logger, wg *sync.WaitGroup, forwardNumCh
 	}
 }
 
-func (t *tunnel) conn2Stream(logger log.Logger, wg *sync.WaitGroup, forwardNumChan chan<- int) {
+func (t *Tunnel) conn2Stream(logger log.Logger, wg *sync.WaitGroup, forwardNumChan chan<- int) {
 	defer func() {
 		(*t.Stream).Close()
 		(*t.Conn).Close()
@@ -196,12 +238,12 @@ func (t *tunnel) conn2Stream(logger log.Logger, wg *sync.WaitGroup, forwardNumCh
 }
 
 // Rewrite io.CopyN function https://pkg.go.dev/io#CopyN
-func (t *tunnel) copyN(dst io.Writer, src io.Reader, n int64, copyNumChan chan<- int) error {
+func (t *Tunnel) copyN(dst io.Writer, src io.Reader, n int64, copyNumChan chan<- int) error {
 	return t.copy(dst, io.LimitReader(src, n), copyNumChan)
 }
 
 // Rewrite io.Copy function https://pkg.go.dev/io#Copy
-func (t *tunnel) copy(dst io.Writer, src io.Reader, nwChan chan<- int) (err error) {
+func (t *Tunnel) copy(dst io.Writer, src io.Reader, nwChan chan<- int) (err error) {
 	size := 32 * 1024
 	if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
 		if l.N < 1 {
@@ -241,10 +283,10 @@ func (t *tunnel) copy(dst io.Writer, src io.Reader, nwChan chan<- int) (err erro
 	return err
 }
 
-func NewTunnel(stream *quic.Stream, endpoint string) tunnel {
+func NewTunnel(stream *quic.Stream, endpoint string) Tunnel {
 	var streamCache = classifier.HeaderCache{}
 	var connCache = classifier.HeaderCache{}
-	return tunnel{
+	return Tunnel{
 		Uuid:        uuid.New(),
 		Stream:      stream,
 		Endpoint:    endpoint,
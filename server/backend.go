@@ -0,0 +1,155 @@
+package server
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/tunnel"
+)
+
+// The strategies to choose the backend of a tunnel if the token resolves to a backend group
+const (
+	// The backends of the group are used in turn.
+	BackendStrategyRoundRobin = "round-robin"
+	// The backend with the least active tunnels is used.
+	BackendStrategyLeastConnections = "least-connections"
+	// The tunnels from the same client application host always use the same
+	// backend while it is reachable, the other backends are barely affected
+	// if a backend is added or removed.
+	BackendStrategyConsistentHash = "consistent-hash"
+)
+
+// parseBackendGroup splits the target parsed from the token into the backends,
+// a backend group is a comma separated list of sockets, e.g.
+// tcp:10.0.0.1:22,tcp:10.0.0.2:22.
+func parseBackendGroup(target string) []string {
+	var backends []string
+	for _, backend := range strings.Split(target, ",") {
+		if backend = strings.TrimSpace(backend); backend != "" {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// backendBalancer decides the order to dial the backends of a group, the
+// backends are dialed one by one until the dial succeeds.
+type backendBalancer struct {
+	strategy string
+	// The round-robin counters of the groups, the keys are the targets parsed from the tokens
+	counters sync.Map
+	mu       sync.Mutex
+	// The number of the tunnels which are dialing each backend, they aren't in
+	// DataStore yet but are counted by least-connections.
+	dialing map[string]int
+}
+
+func newBackendBalancer(strategy string) *backendBalancer {
+	return &backendBalancer{strategy: strategy, dialing: map[string]int{}}
+}
+
+// order return the backends in the order to dial, clientAppAddr is used by consistent-hash.
+func (b *backendBalancer) order(target string, backends []string, clientAppAddr string) []string {
+	if len(backends) <= 1 {
+		return backends
+	}
+	switch b.strategy {
+	case BackendStrategyConsistentHash:
+		// The client endpoints of the v1 handshake don't send the client application address.
+		if clientAppAddr != "" {
+			return rendezvousOrder(backends, clientAppHost(clientAppAddr))
+		}
+		return b.rotate(target, backends)
+	case BackendStrategyLeastConnections:
+		// The backends with the same number of tunnels are used in turn
+		ordered := b.rotate(target, backends)
+		counts := b.connections()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return counts[ordered[i]] < counts[ordered[j]]
+		})
+		return ordered
+	default:
+		return b.rotate(target, backends)
+	}
+}
+
+// rotate return the backends starting from the next one of the group.
+func (b *backendBalancer) rotate(target string, backends []string) []string {
+	counter, _ := b.counters.LoadOrStore(target, new(uint32))
+	start := int((atomic.AddUint32(counter.(*uint32), 1) - 1) % uint32(len(backends)))
+	return append(append([]string{}, backends[start:]...), backends[:start]...)
+}
+
+// connections return the number of the active and dialing tunnels of each backend.
+func (b *backendBalancer) connections() map[string]int {
+	counts := map[string]int{}
+	for _, t := range tunnel.DataStore.LoadAll() {
+		if t.Endpoint == constants.ServerEndpoint && t.Backend != "" {
+			counts[t.Backend]++
+		}
+	}
+	b.mu.Lock()
+	for backend, n := range b.dialing {
+		counts[backend] += n
+	}
+	b.mu.Unlock()
+	return counts
+}
+
+// startDial counts the tunnel dialing the backend, the returned function must be
+// called once the dial returned.
+func (b *backendBalancer) startDial(backend string) func() {
+	b.mu.Lock()
+	b.dialing[backend]++
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		if b.dialing[backend]--; b.dialing[backend] <= 0 {
+			delete(b.dialing, backend)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// clientAppHost return the host of the client application address, the port
+// changes for every connection, so it isn't hashed.
+func clientAppHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rendezvousOrder sorts the backends by their scores for the key in descending
+// order, so that the key always prefers the same backend, and falls back to
+// the same next one if it is unreachable.
+func rendezvousOrder(backends []string, key string) []string {
+	scores := make(map[string]uint64, len(backends))
+	for _, backend := range backends {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(backend))
+		scores[backend] = mix64(h.Sum64())
+	}
+	ordered := append([]string{}, backends...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i]] > scores[ordered[j]]
+	})
+	return ordered
+}
+
+// mix64 is the finalizer of SplitMix64, FNV alone doesn't spread the similar keys well.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -5,17 +5,20 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
-	"fmt"
 	"math/big"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
+	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
 	"github.com/kungze/quic-tun/pkg/options"
 	"github.com/kungze/quic-tun/pkg/restfulapi"
@@ -26,10 +29,11 @@ import (
 )
 
 var (
-	serOptions *options.ServerOptions
-	apiOptions *options.RestfulAPIOptions
-	secOptions *options.SecureOptions
-	logOptions *log.Options
+	serOptions  *options.ServerOptions
+	apiOptions  *options.RestfulAPIOptions
+	secOptions  *options.SecureOptions
+	logOptions  *log.Options
+	listPlugins bool
 )
 
 func buildCommand(basename string) *cobra.Command {
@@ -50,18 +54,26 @@ Find more quic-tun information at:
 	secOptions.AddFlags(rootCmd.Flags())
 	options.AddConfigFlag(basename, rootCmd.Flags())
 	logOptions.AddFlags(rootCmd.Flags())
+	rootCmd.Flags().BoolVar(&listPlugins, "list-plugins", false,
+		"List the token plugins and discriminators compiled in the binary, then exit.")
 
 	return rootCmd
 }
 
 func runCommand(cmd *cobra.Command, args []string) error {
+	if listPlugins {
+		options.PrintPlugins(constants.ServerEndpoint)
+		return nil
+	}
 	options.PrintWorkingDir()
 	options.PrintFlags(cmd.Flags())
-	options.PrintConfig()
 
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
 		return err
 	}
+	// The config is printed after the flags are bound, so that it shows the
+	// values taking effect, no matter they come from flags, env or config file.
+	options.PrintConfig()
 
 	if err := viper.Unmarshal(serOptions); err != nil {
 		return err
@@ -80,11 +92,10 @@ func runCommand(cmd *cobra.Command, args []string) error {
 	}
 
 	// run server
-	runFunc(serOptions, apiOptions, secOptions)
-	return nil
+	return runFunc(serOptions, apiOptions, secOptions)
 }
 
-func runFunc(so *options.ServerOptions, ao *options.RestfulAPIOptions, seco *options.SecureOptions) {
+func runFunc(so *options.ServerOptions, ao *options.RestfulAPIOptions, seco *options.SecureOptions) error {
 	log.Init(logOptions)
 	defer log.Flush()
 
@@ -92,17 +103,25 @@ func runFunc(so *options.ServerOptions, ao *options.RestfulAPIOptions, seco *opt
 	certFile := seco.CertFile
 	verifyClient := seco.VerifyRemoteEndpoint
 	caFile := seco.CaFile
-	tokenParserPlugin := so.TokenParserPlugin
-	tokenParserKey := so.TokenParserKey
+
+	if so.IdentityMapFile != "" && !verifyClient {
+		err := errors.New("the identity map requires --verify-remote-endpoint")
+		log.Errorw("The options are invalid.", "error", err.Error())
+		return err
+	}
 
 	var tlsConfig *tls.Config
 	if keyFile == "" || certFile == "" {
-		tlsConfig = generateTLSConfig()
+		var err error
+		if tlsConfig, err = generateTLSConfig(); err != nil {
+			log.Errorw("Failed to generate TLS config.", "error", err.Error())
+			return err
+		}
 	} else {
 		tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			log.Errorw("Certificate file or private key file is invalid.", "error", err.Error())
-			return
+			return err
 		}
 		tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{tlsCert},
@@ -115,13 +134,14 @@ func runFunc(so *options.ServerOptions, ao *options.RestfulAPIOptions, seco *opt
 			certPool, err := x509.SystemCertPool()
 			if err != nil {
 				log.Errorw("Failed to load system cert pool", "error", err.Error())
-				return
+				return err
 			}
 			tlsConfig.ClientCAs = certPool
 		} else {
 			caPemBlock, err := os.ReadFile(caFile)
 			if err != nil {
 				log.Errorw("Failed to read ca file.", "error", err.Error())
+				return err
 			}
 			certPool := x509.NewCertPool()
 			certPool.AppendCertsFromPEM(caPemBlock)
@@ -130,50 +150,87 @@ func runFunc(so *options.ServerOptions, ao *options.RestfulAPIOptions, seco *opt
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
+	s, err := server.NewServerEndpoint(so, tlsConfig)
+	if err != nil {
+		log.Errorw("Failed to create server endpoint.", "error", err.Error())
+		return err
+	}
+
+	// The API server and server endpoint are shut down gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start API server
 	httpd := restfulapi.NewHttpd(ao.HttpdListenOn)
-	go httpd.Start()
+	httpd.Token = ao.HttpdToken
+	httpd.AddGetter("/registrations", func() any { return s.Registrations() })
+	if catalog, ok := s.TokenParser.(token.CatalogProvider); ok {
+		httpd.AddGetter("/catalog", func() any { return catalog.Services() })
+		httpd.AddGetter("/backends", func() any { return s.BackendHealth() })
+		httpd.AddMetrics(func() []restfulapi.Metric { return backendMetrics(s.BackendHealth()) })
+		// These APIs show the internal addresses which the catalog hides from client endpoints,
+		// the tunnels show their backends and the registrations show their listen sockets.
+		httpd.Protect("/catalog", "/backends", "/metrics", "/tunnels", "/registrations")
+	}
+	httpd.SetMaintainer(s)
+	go func() {
+		if err := httpd.Run(ctx); err != nil {
+			log.Errorw("API server exited.", "error", err.Error())
+		}
+	}()
 
 	// Start server endpoint
-	s := &server.ServerEndpoint{
-		Address:     so.ListenOn,
-		TlsConfig:   tlsConfig,
-		TokenParser: loadTokenParserPlugin(tokenParserPlugin, tokenParserKey),
+	if err := s.Run(ctx); err != nil {
+		log.Errorw("Server endpoint exited.", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+// backendMetrics converts the health of the backends to the metrics
+func backendMetrics(health []server.BackendHealth) []restfulapi.Metric {
+	var metrics []restfulapi.Metric
+	for _, b := range health {
+		var up float64
+		if b.Healthy {
+			up = 1
+		}
+		metrics = append(metrics,
+			restfulapi.Metric{Name: "quictun_backend_healthy", Help: "Whether the backend is healthy by the health checks.",
+				Type: restfulapi.MetricGauge, Labels: map[string]string{"backend": b.Backend}, Value: up},
+			restfulapi.Metric{Name: "quictun_backend_consecutive_failures", Help: "The number of the consecutive failed health checks of the backend.",
+				Type: restfulapi.MetricGauge, Labels: map[string]string{"backend": b.Backend}, Value: float64(b.ConsecutiveFailures)},
+			restfulapi.Metric{Name: "quictun_backend_health_checks_total", Help: "The number of the health checks of the backend.",
+				Type: restfulapi.MetricCounter, Labels: map[string]string{"backend": b.Backend, "result": "success"}, Value: float64(b.Successes)},
+			restfulapi.Metric{Name: "quictun_backend_health_checks_total", Help: "The number of the health checks of the backend.",
+				Type: restfulapi.MetricCounter, Labels: map[string]string{"backend": b.Backend, "result": "failure"}, Value: float64(b.Failures)},
+		)
 	}
-	s.Start()
+	return metrics
 }
 
 // Setup a bare-bones TLS config for the server
-func generateTLSConfig() *tls.Config {
+func generateTLSConfig() (*tls.Config, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	template := x509.Certificate{SerialNumber: big.NewInt(1)}
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 
 	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		NextProtos:   []string{"quic-tun"},
-	}
-}
-
-func loadTokenParserPlugin(plugin string, key string) token.TokenParserPlugin {
-	switch strings.ToLower(plugin) {
-	case "cleartext":
-		return token.NewCleartextTokenParserPlugin(key)
-	default:
-		panic(fmt.Sprintf("Token parser plugin %s don't support", plugin))
-	}
+	}, nil
 }
 
 func main() {
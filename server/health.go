@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/token"
+)
+
+const (
+	// A backend is unhealthy after the number of consecutive failed health
+	// checks, a successful check makes it healthy again.
+	maxHealthCheckFailures = 2
+	// The number of the latest health check results kept for each backend
+	healthHistoryLength = 10
+	// The max size of the response read by the health checks with expect
+	maxHealthCheckResponse = 4096
+)
+
+// HealthCheckResult is the result of a health check.
+type HealthCheckResult struct {
+	Time    string `json:"time"`
+	Success bool   `json:"success"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BackendHealth describes the health of a backend and its latest health checks.
+type BackendHealth struct {
+	Backend string `json:"backend"`
+	// The catalog services which the backend belongs to
+	Services            []string `json:"services"`
+	Healthy             bool     `json:"healthy"`
+	ConsecutiveFailures int      `json:"consecutiveFailures"`
+	// The number of the health checks since server endpoint started
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+	// The latest results, the newest one is the last
+	History []HealthCheckResult `json:"history"`
+}
+
+type backendState struct {
+	services            []string
+	consecutiveFailures int
+	successes           int64
+	failures            int64
+	history             []HealthCheckResult
+}
+
+func (b *backendState) healthy() bool {
+	return b.consecutiveFailures < maxHealthCheckFailures
+}
+
+// healthChecker checks the TCP/UNIX backends in the catalog periodically, the
+// unhealthy backends are skipped when server endpoint dials a backend group.
+// The backends which aren't in the catalog are always considered healthy.
+type healthChecker struct {
+	catalog  token.CatalogProvider
+	interval time.Duration
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*backendState
+}
+
+func newHealthChecker(catalog token.CatalogProvider, interval, timeout time.Duration) *healthChecker {
+	return &healthChecker{catalog: catalog, interval: interval, timeout: timeout, backends: map[string]*backendState{}}
+}
+
+// Run checks the backends until stop is closed.
+func (h *healthChecker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refresh updates the backends from the catalog, because the catalog file may be
+// reloaded. The states of the backends which are still in the catalog are kept.
+func (h *healthChecker) refresh() map[string]token.CatalogHealthCheck {
+	checks := map[string]token.CatalogHealthCheck{}
+	services := map[string][]string{}
+	for _, service := range h.catalog.Services() {
+		for _, target := range service.Targets {
+			scheme, _, _ := strings.Cut(target, ":")
+			if strings.HasPrefix(strings.ToLower(scheme), "udp") {
+				continue
+			}
+			// If a backend belongs to multiple services, the first service's check is used.
+			if _, ok := checks[target]; !ok {
+				var check token.CatalogHealthCheck
+				if service.HealthCheck != nil {
+					check = *service.HealthCheck
+				}
+				checks[target] = check
+			}
+			services[target] = append(services[target], service.Name)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for backend := range h.backends {
+		if _, ok := checks[backend]; !ok {
+			delete(h.backends, backend)
+		}
+	}
+	for backend := range checks {
+		state, ok := h.backends[backend]
+		if !ok {
+			state = &backendState{}
+			h.backends[backend] = state
+		}
+		state.services = services[backend]
+	}
+	return checks
+}
+
+// checkAll checks all backends concurrently, it returns once all checks finished.
+func (h *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for backend, check := range h.refresh() {
+		wg.Add(1)
+		go func(backend string, check token.CatalogHealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := h.check(backend, check)
+			h.record(backend, start, err)
+		}(backend, check)
+	}
+	wg.Wait()
+}
+
+// check connects the backend, then sends the data and waits for the expected
+// response if the check specifies them.
+func (h *healthChecker) check(backend string, check token.CatalogHealthCheck) error {
+	deadline := time.Now().Add(h.timeout)
+	scheme, addr, _ := strings.Cut(backend, ":")
+	conn, err := net.DialTimeout(strings.ToLower(scheme), addr, h.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	if check.Send != "" {
+		if _, err = conn.Write([]byte(check.Send)); err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+	}
+	if check.Expect == "" {
+		return nil
+	}
+	var resp []byte
+	buf := make([]byte, 512)
+	for len(resp) < maxHealthCheckResponse {
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if bytes.Contains(resp, []byte(check.Expect)) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("the response doesn't contain %q: %w", check.Expect, err)
+		}
+	}
+	return fmt.Errorf("the response doesn't contain %q", check.Expect)
+}
+
+// record saves the result of a health check, the changes of the health are logged.
+func (h *healthChecker) record(backend string, start time.Time, err error) {
+	result := HealthCheckResult{Time: start.String(), Success: err == nil, Latency: time.Since(start).String()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	h.mu.Lock()
+	state, ok := h.backends[backend]
+	if !ok {
+		// The backend was removed from the catalog during the check
+		h.mu.Unlock()
+		return
+	}
+	wasHealthy := state.healthy()
+	if err != nil {
+		state.consecutiveFailures++
+		state.failures++
+	} else {
+		state.consecutiveFailures = 0
+		state.successes++
+	}
+	state.history = append(state.history, result)
+	if len(state.history) > healthHistoryLength {
+		state.history = state.history[len(state.history)-healthHistoryLength:]
+	}
+	isHealthy := state.healthy()
+	h.mu.Unlock()
+	if wasHealthy == isHealthy {
+		return
+	}
+	if isHealthy {
+		log.Infow("The backend becomes healthy", constants.Backend, backend)
+	} else {
+		log.Warnw("The backend becomes unhealthy, the new tunnels skip it.", constants.Backend, backend, "error", result.Error)
+	}
+}
+
+// healthy reports whether the backend is healthy, the backends which aren't
+// checked are healthy. A nil checker means the health checks are disabled.
+func (h *healthChecker) healthy(backend string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.backends[backend]; ok {
+		return state.healthy()
+	}
+	return true
+}
+
+// Statuses return the health of all checked backends.
+func (h *healthChecker) Statuses() []BackendHealth {
+	if h == nil {
+		return []BackendHealth{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	statuses := make([]BackendHealth, 0, len(h.backends))
+	for backend, state := range h.backends {
+		statuses = append(statuses, BackendHealth{
+			Backend:             backend,
+			Services:            append([]string{}, state.services...),
+			Healthy:             state.healthy(),
+			ConsecutiveFailures: state.consecutiveFailures,
+			Successes:           state.successes,
+			Failures:            state.failures,
+			History:             append([]HealthCheckResult{}, state.history...),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Backend < statuses[j].Backend })
+	return statuses
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kungze/quic-tun/pkg/constants"
+	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/options"
+	"github.com/kungze/quic-tun/pkg/policy"
+	"github.com/kungze/quic-tun/pkg/token"
+	"github.com/kungze/quic-tun/pkg/tunnel"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Registration is a reverse forward rule registered by a client endpoint. Server
+// endpoint listens on ListenOn, the accepted connections are forwarded to the
+// client endpoint, and the client endpoint connects the application behind it.
+type Registration struct {
+	Uuid uuid.UUID `json:"uuid"`
+	// The ID of the QUIC stream used to register, it identifies the registration in the session.
+	StreamID           quic.StreamID `json:"streamId"`
+	ClientEndpointAddr string        `json:"clientEndpointAddr"`
+	ListenOn           string        `json:"listenOn"`
+	Subject            string        `json:"subject,omitempty"`
+	CreatedAt          string        `json:"createdAt"`
+	// The identity of the client endpoint's certificate
+	PeerIdentity *token.PeerIdentity `json:"peerIdentity,omitempty"`
+	listener     net.Listener
+	// The handshake version of the registration, the reverse tunnels use it too.
+	version int
+}
+
+// Registrations return the reverse forward rules registered by client endpoints.
+func (s *ServerEndpoint) Registrations() []Registration {
+	s.setup()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registrations := make([]Registration, 0, len(s.registrations))
+	for _, reg := range s.registrations {
+		registrations = append(registrations, *reg)
+	}
+	return registrations
+}
+
+// register processes the registration of a reverse forward rule. The token is
+// parsed by the token parser plugin to get the socket to listen on, so the
+// registrations are authorized by the token parser plugin, the identity map and
+// the access control policy just like tunnels.
+func (s *ServerEndpoint) register(ctx context.Context, session quic.Session, stream *quic.Stream, hsh *tunnel.HandshakeHelper) {
+	logger := log.FromContext(ctx)
+	refuse := func(ack byte, message string) {
+		_ = hsh.SendAck(*stream, ack, message)
+		(*stream).Close()
+	}
+	if !s.AllowReverse {
+		logger.Warn("Reverse forward isn't allowed, refuse the registration.")
+		refuse(constants.RegistrationRefused, "reverse forward isn't allowed")
+		return
+	}
+	claims, err := token.ParseTokenContext(session.Context(), *hsh.TokenParser, strings.TrimPrefix(hsh.ReceiveData, constants.ReverseTokenPrefix), hsh.PeerIdentity)
+	if err != nil {
+		logger.Errorw("Failed to parse token", "error", err.Error())
+		refuse(constants.ParseTokenError, "failed to parse token: "+err.Error())
+		return
+	}
+	socket := claims.Target
+	logger = logger.WithValues(constants.ReverseListenOn, socket)
+	if claims.Subject != "" {
+		logger = logger.WithValues(constants.Subject, claims.Subject)
+	}
+	if len(parseBackendGroup(socket)) > 1 {
+		logger.Error("The token of the reverse forward rule resolves to a backend group")
+		refuse(constants.RegistrationRefused, "the reverse forward rule can't listen on a backend group")
+		return
+	}
+	if err := options.ValidateSocket(socket, "tcp", "unix"); err != nil {
+		logger.Errorw("The socket of the reverse forward rule is invalid", "error", err.Error())
+		refuse(constants.RegistrationRefused, err.Error())
+		return
+	}
+	if s.IdentityMap != nil && !s.IdentityMap.Permitted(hsh.PeerIdentity.Identities(), socket) {
+		logger.Warn("The socket of the reverse forward rule isn't permitted for the client endpoint's identity by the identity map")
+		refuse(constants.DeniedByPolicy, fmt.Sprintf("the identity %q isn't permitted to listen on %s", hsh.PeerIdentity.String(), socket))
+		return
+	}
+	// The socket is checked like a server application, the hostname is resolved
+	// and the server endpoint listens on the allowed IP.
+	if s.Policy != nil {
+		resolved, err := s.Policy.Resolve(ctx, socket, hsh.PeerIdentity.Identities())
+		if errors.Is(err, policy.ErrDenied) {
+			logger.Warnw("The socket of the reverse forward rule is denied by the access control policy", "error", err.Error())
+			refuse(constants.DeniedByPolicy, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Errorw("Failed to resolve the socket of the reverse forward rule", "error", err.Error())
+			refuse(constants.RegistrationRefused, "failed to resolve "+socket+": "+err.Error())
+			return
+		}
+		socket = resolved
+	}
+	sockets := strings.Split(socket, ":")
+	listener, err := net.Listen(strings.ToLower(sockets[0]), strings.Join(sockets[1:], ":"))
+	if err != nil {
+		logger.Errorw("Failed to listen on the socket of the reverse forward rule", "error", err.Error())
+		refuse(constants.RegistrationRefused, "failed to listen on "+socket+": "+err.Error())
+		return
+	}
+	reg := &Registration{
+		Uuid:               uuid.New(),
+		StreamID:           (*stream).StreamID(),
+		ClientEndpointAddr: session.RemoteAddr().String(),
+		ListenOn:           socket,
+		Subject:            claims.Subject,
+		CreatedAt:          time.Now().String(),
+		PeerIdentity:       hsh.PeerIdentity,
+		listener:           listener,
+		version:            hsh.Version,
+	}
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		listener.Close()
+		logger.Warn("Server endpoint is shutting down, refuse the registration.")
+		refuse(constants.EndpointDraining, "server endpoint is shutting down")
+		return
+	}
+	s.registrations[reg.Uuid] = reg
+	s.serving.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer s.serving.Done()
+		s.serveRegistration(logger, session, stream, hsh, reg)
+	}()
+}
+
+// serveRegistration accepts the connections of the registration, it returns once
+// the client endpoint closes the registration stream or the session is broken.
+func (s *ServerEndpoint) serveRegistration(logger log.Logger, session quic.Session, stream *quic.Stream, hsh *tunnel.HandshakeHelper, reg *Registration) {
+	defer func() {
+		reg.listener.Close()
+		(*stream).CancelRead(0)
+		(*stream).Close()
+		s.mu.Lock()
+		delete(s.registrations, reg.Uuid)
+		s.mu.Unlock()
+		logger.Info("Reverse forward rule unregistered")
+	}()
+	if err := hsh.SendAck(*stream, constants.HandshakeSuccess, ""); err != nil {
+		logger.Errorw("Faied to send ack info", "error", err.Error())
+		return
+	}
+	logger.Info("Reverse forward rule registered")
+	// The registration stream is kept open during the registration's lifetime.
+	go func() {
+		_, _ = io.Copy(io.Discard, *stream)
+		reg.listener.Close()
+	}()
+	for {
+		conn, err := reg.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorw("Client app connect failed", "error", err.Error())
+			continue
+		}
+		logger := logger.WithValues(constants.ClientAppAddr, conn.RemoteAddr().String())
+		// The tunnels are counted under the lock, so that no tunnel is counted after shutdown start to wait them.
+		s.mu.Lock()
+		if s.draining || s.InMaintenance() {
+			s.mu.Unlock()
+			logger.Warn("Server endpoint is in maintenance mode or shutting down, refuse the connection.")
+			conn.Close()
+			continue
+		}
+		s.tunnels.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.tunnels.Done()
+			s.handleReverseConn(logger, session, reg, conn)
+		}()
+	}
+}
+
+func (s *ServerEndpoint) handleReverseConn(logger log.Logger, session quic.Session, reg *Registration, conn net.Conn) {
+	defer conn.Close()
+	// Open a quic stream for each connection, the client endpoint accepts it.
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		logger.Errorw("Failed to open stream to client endpoint.", "error", err.Error())
+		return
+	}
+	logger = logger.WithValues(constants.StreamID, stream.StreamID())
+	ctx := logger.WithContext(context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String()))
+	hsh := tunnel.NewHandshakeHelper(constants.TokenLength, func(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
+		return reverseHandshake(ctx, stream, hsh, fmt.Sprint(reg.StreamID))
+	})
+	hsh.Version = reg.version
+	tun := tunnel.NewTunnel(&stream, constants.ServerEndpoint)
+	tun.Conn = &conn
+	tun.Hsh = &hsh
+	tun.Reverse = true
+	tun.Subject = reg.Subject
+	tun.PeerIdentity = reg.PeerIdentity
+	tun.Hooks = &s.Hooks
+	if !tun.HandShake(ctx) {
+		stream.Close()
+		return
+	}
+	tun.Establish(ctx)
+}
+
+// reverseHandshake tells client endpoint which registration the tunnel belongs to,
+// and waits for client endpoint to connect the application behind it. The ID is
+// sent like a token in the handshake version of the registration, the v1 ID is
+// padded to constants.TokenLength, --token-length only applies to client tokens.
+func reverseHandshake(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper, id string) (bool, *net.Conn) {
+	logger := log.FromContext(ctx)
+	logger.Info("Starting reverse handshake with client endpoint")
+	if err := hsh.SendToken(*stream, id); err != nil {
+		logger.Errorw("Failed to send registration ID", "error", err.Error())
+		return false, nil
+	}
+	ack, err := hsh.ReceiveAck(*stream)
+	if err != nil {
+		logger.Errorw("Failed to receive ack", "error", err.Error())
+		return false, nil
+	}
+	switch ack {
+	case constants.HandshakeSuccess:
+		logger.Info("Handshake successful")
+		return true, nil
+	case constants.CannotConnServer:
+		message := "client endpoint can not connect to the application"
+		if hsh.Message != "" {
+			message += ": " + hsh.Message
+		}
+		logger.Errorw("handshake error!", "error", message)
+		return false, nil
+	default:
+		logger.Errorw("handshake error!", "error", "received an unknow ack info")
+		return false, nil
+	}
+}
@@ -3,12 +3,19 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"io"
+	"errors"
+	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/kungze/quic-tun/pkg/constants"
 	"github.com/kungze/quic-tun/pkg/log"
+	"github.com/kungze/quic-tun/pkg/options"
+	"github.com/kungze/quic-tun/pkg/policy"
 	"github.com/kungze/quic-tun/pkg/token"
 	"github.com/kungze/quic-tun/pkg/tunnel"
 	"github.com/lucas-clemente/quic-go"
@@ -18,82 +25,568 @@ type ServerEndpoint struct {
 	Address     string
 	TlsConfig   *tls.Config
 	TokenParser token.TokenParserPlugin
+	// The max time to wait for the active tunnels to finish after the context
+	// passed to Run is canceled.
+	DrainTimeout time.Duration
+	// The UDP flow is closed after it is idle for the duration
+	UDPIdleTimeout time.Duration
+	// Allow client endpoints to register reverse forward rules
+	AllowReverse bool
+	// The length of the tokens, it must be same as client endpoint's. Zero means constants.TokenLength.
+	TokenLength int
+	// The callbacks of the tunnels' lifecycle events
+	Hooks tunnel.Hooks
+	// The access control policy of the server applications, nil means all are allowed.
+	Policy *policy.Policy
+	// It decides which server applications each client endpoint identity can connect,
+	// nil means the identities aren't checked.
+	IdentityMap *policy.IdentityMap
+	// The config of the QUIC transport, nil means the defaults of quic-go.
+	// The datagrams are always enabled for the UDP tunnels.
+	QuicConfig *quic.Config
+	// The buffer sizes of the UDP socket, zero means the system default.
+	UDPReadBuffer  int
+	UDPWriteBuffer int
+	// The strategy to choose the backend if the token resolves to a backend group,
+	// empty means round-robin.
+	BackendStrategy string
+	// The timeout to dial each backend, zero means no timeout.
+	BackendDialTimeout time.Duration
+	// The interval of the health checks of the backends in the catalog, zero means
+	// they aren't checked. It only takes effect if TokenParser provides a catalog.
+	HealthCheckInterval time.Duration
+	// A health check fails if it doesn't finish within the duration.
+	HealthCheckTimeout time.Duration
+
+	setupOnce    sync.Once
+	backends     *backendBalancer
+	health       *healthChecker
+	mu           sync.Mutex
+	listener     quic.Listener
+	packetConn   net.PacketConn
+	sessions     map[quic.Session]struct{}
+	draining     bool
+	maintenance  int32
+	serving      sync.WaitGroup
+	tunnels      sync.WaitGroup
+	shutdownOnce sync.Once
+	// The reverse forward rules registered by client endpoints
+	registrations map[uuid.UUID]*Registration
+	// Closed after the endpoint was shut down
+	stopped chan struct{}
+}
+
+func (s *ServerEndpoint) tokenLength() int64 {
+	if s.TokenLength > 0 {
+		return int64(s.TokenLength)
+	}
+	return constants.TokenLength
+}
+
+func (s *ServerEndpoint) setup() {
+	s.setupOnce.Do(func() {
+		s.sessions = map[quic.Session]struct{}{}
+		s.registrations = map[uuid.UUID]*Registration{}
+		s.stopped = make(chan struct{})
+		s.backends = newBackendBalancer(s.BackendStrategy)
+		if catalog, ok := s.TokenParser.(token.CatalogProvider); ok && s.HealthCheckInterval > 0 {
+			s.health = newHealthChecker(catalog, s.HealthCheckInterval, s.HealthCheckTimeout)
+		}
+	})
+}
+
+// BackendHealth return the health of the backends in the catalog, it is empty
+// if the health checks are disabled.
+func (s *ServerEndpoint) BackendHealth() []BackendHealth {
+	s.setup()
+	return s.health.Statuses()
+}
+
+// InMaintenance reports whether the endpoint is in maintenance mode.
+func (s *ServerEndpoint) InMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// SetMaintenance turns on/off maintenance mode. In maintenance mode, the endpoint
+// refuses new tunnels, but the active tunnels are not affected.
+func (s *ServerEndpoint) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenance, v)
+	log.Infow("Server endpoint maintenance mode changed", "maintenance", enabled)
 }
 
-func (s *ServerEndpoint) Start() {
+// refusing reports whether the endpoint refuses new tunnels
+func (s *ServerEndpoint) refusing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining || s.InMaintenance()
+}
+
+// NewServerEndpoint validates the options and creates a server endpoint, the
+// token parser plugin is loaded according to the options.
+func NewServerEndpoint(so *options.ServerOptions, tlsConfig *tls.Config) (*ServerEndpoint, error) {
+	if err := so.Validate(); err != nil {
+		return nil, err
+	}
+	tokenParser, err := token.NewTokenParserPluginWithConfig(so.TokenParserPlugin, so.TokenParserKey,
+		so.GetTokenPluginConfig(so.TokenParserPlugin))
+	if err != nil {
+		return nil, err
+	}
+	var p *policy.Policy
+	if so.PolicyFile != "" {
+		var err error
+		if p, err = policy.Load(so.PolicyFile); err != nil {
+			return nil, err
+		}
+	}
+	var identityMap *policy.IdentityMap
+	if so.IdentityMapFile != "" {
+		var err error
+		if identityMap, err = policy.LoadIdentityMap(so.IdentityMapFile); err != nil {
+			return nil, err
+		}
+	}
+	return &ServerEndpoint{
+		Address:             so.ListenOn,
+		TlsConfig:           tlsConfig,
+		TokenParser:         tokenParser,
+		DrainTimeout:        so.DrainTimeout,
+		UDPIdleTimeout:      so.UDPIdleTimeout,
+		AllowReverse:        so.AllowReverse,
+		TokenLength:         so.TokenLength,
+		Policy:              p,
+		IdentityMap:         identityMap,
+		QuicConfig:          tunnel.NewQuicConfig(&so.Transport),
+		UDPReadBuffer:       so.Transport.UDPReadBuffer,
+		UDPWriteBuffer:      so.Transport.UDPWriteBuffer,
+		BackendStrategy:     so.BackendStrategy,
+		BackendDialTimeout:  so.BackendDialTimeout,
+		HealthCheckInterval: so.HealthCheckInterval,
+		HealthCheckTimeout:  so.HealthCheckTimeout,
+	}, nil
+}
+
+// Run listens on a QUIC socket and accepts the sessions from client endpoints.
+// It blocks until the endpoint is shut down, once ctx is canceled, the endpoint
+// is shut down with DrainTimeout. If the socket cannot be listened on, it returns
+// the error immediately.
+func (s *ServerEndpoint) Run(ctx context.Context) error {
+	s.setup()
+	if s.TokenParser == nil {
+		return errors.New("the token parser plugin is not specified")
+	}
 	// Listen a quic(UDP) socket.
-	listener, err := quic.ListenAddr(s.Address, s.TlsConfig, nil)
+	udpAddr, err := net.ResolveUDPAddr("udp", s.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.Address, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.Address, err)
+	}
+	listener, err := quic.Listen(conn, s.TlsConfig, s.quicConfig())
 	if err != nil {
-		panic(err)
+		conn.Close()
+		return fmt.Errorf("failed to listen on %s: %w", s.Address, err)
+	}
+	if err = tunnel.SetSocketBuffers(conn, s.UDPReadBuffer, s.UDPWriteBuffer); err != nil {
+		listener.Close()
+		conn.Close()
+		return err
 	}
-	defer listener.Close()
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		listener.Close()
+		conn.Close()
+		return errors.New("server endpoint is already shut down")
+	}
+	s.listener = listener
+	s.packetConn = conn
+	s.serving.Add(1)
+	s.mu.Unlock()
 	log.Infow("Server endpoint start up successful", "listen address", listener.Addr())
+	if s.health != nil {
+		go s.health.Run(s.stopped)
+	}
+	go func() {
+		defer s.serving.Done()
+		s.serve(listener)
+	}()
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+		defer cancel()
+		_ = s.Shutdown(shutdownCtx)
+	case <-s.stopped:
+	}
+	return nil
+}
+
+// Shutdown refuses new sessions and tunnels, and waits for the active tunnels to
+// finish. If ctx is done before that, all sessions are closed which breaks the
+// remaining tunnels, and the ctx's error is returned.
+func (s *ServerEndpoint) Shutdown(ctx context.Context) error {
+	s.setup()
+	var err error
+	s.shutdownOnce.Do(func() {
+		log.Info("Server endpoint is shutting down, refuse new sessions and tunnels.")
+		s.mu.Lock()
+		s.draining = true
+		// Stop accepting new connections of the reverse forward rules
+		for _, reg := range s.registrations {
+			reg.listener.Close()
+		}
+		s.mu.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			s.tunnels.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			log.Info("All tunnels are finished.")
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Warnw("Timeout to wait the tunnels to finish, close them forcibly.", "error", err.Error())
+		}
+		// Closing listener closes all sessions too.
+		s.mu.Lock()
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		for session := range s.sessions {
+			_ = session.CloseWithError(0, "server endpoint is shut down")
+		}
+		// The socket isn't closed by the listener, because it isn't created by quic-go.
+		if s.packetConn != nil {
+			s.packetConn.Close()
+		}
+		s.mu.Unlock()
+		s.serving.Wait()
+		<-drained
+		close(s.stopped)
+	})
+	<-s.stopped
+	return err
+}
+
+func (s *ServerEndpoint) quicConfig() *quic.Config {
+	config := &quic.Config{}
+	if s.QuicConfig != nil {
+		config = s.QuicConfig.Clone()
+	}
+	config.EnableDatagrams = true
+	return config
+}
+
+func (s *ServerEndpoint) serve(listener quic.Listener) {
 	for {
 		// Wait client endpoint connection request.
 		session, err := listener.Accept(context.Background())
 		if err != nil {
+			if s.refusing() {
+				return
+			}
 			log.Errorw("Encounter error when accept a connection.", "error", err.Error())
-		} else {
-			parent_ctx := context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String())
-			logger := log.WithValues(constants.ClientEndpointAddr, session.RemoteAddr().String())
-			logger.Info("A new client endpoint connect request accepted.")
-			go func() {
-				for {
-					// Wait client endpoint open a stream (A new steam means a new tunnel)
-					stream, err := session.AcceptStream(context.Background())
-					if err != nil {
-						logger.Errorw("Cannot accept a new stream.", "error", err.Error())
-						break
-					}
-					logger := logger.WithValues(constants.StreamID, stream.StreamID())
-					ctx := logger.WithContext(parent_ctx)
-					hsh := tunnel.NewHandshakeHelper(constants.AckMsgLength, handshake)
-					hsh.TokenParser = &s.TokenParser
-
-					tun := tunnel.NewTunnel(&stream, constants.ServerEndpoint)
-					tun.Hsh = &hsh
-					if !tun.HandShake(ctx) {
-						continue
-					}
-					// After handshake successful the server application's address is established we can add it to log
-					ctx = logger.WithValues(constants.ServerAppAddr, (*tun.Conn).RemoteAddr().String()).WithContext(ctx)
-					go tun.Establish(ctx)
-				}
+			continue
+		}
+		logger := log.WithValues(constants.ClientEndpointAddr, session.RemoteAddr().String())
+		s.mu.Lock()
+		if s.draining {
+			s.mu.Unlock()
+			logger.Warn("Server endpoint is shutting down, refuse the new client endpoint.")
+			_ = session.CloseWithError(0, "server endpoint is shutting down")
+			continue
+		}
+		s.sessions[session] = struct{}{}
+		s.serving.Add(1)
+		s.mu.Unlock()
+		logger.Info("A new client endpoint connect request accepted.")
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.sessions, session)
+				s.mu.Unlock()
+				s.serving.Done()
 			}()
+			s.serveSession(logger, session)
+		}()
+	}
+}
+
+func (s *ServerEndpoint) serveSession(logger log.Logger, session quic.Session) {
+	parent_ctx := context.WithValue(context.TODO(), constants.CtxRemoteEndpointAddr, session.RemoteAddr().String())
+	identity := peerIdentity(session)
+	if identity != nil {
+		logger = logger.WithValues(constants.PeerIdentity, identity.String())
+	}
+	for {
+		// Wait client endpoint open a stream (A new steam means a new tunnel)
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			logger.Errorw("Cannot accept a new stream.", "error", err.Error())
+			break
+		}
+		logger := logger.WithValues(constants.StreamID, stream.StreamID())
+		// Each stream is served in its own goroutine, so that a slow handshake, e.g. a slow
+		// token parser or dialing the dead backends, doesn't block the other streams of the
+		// session. The tunnels are counted under the lock, so that no tunnel is counted after
+		// shutdown start to wait them. During shutdown, the handshake only refuses the stream,
+		// it is counted as serving, the session's own count keeps the wait group positive.
+		s.mu.Lock()
+		draining := s.draining
+		if draining {
+			s.serving.Add(1)
+		} else {
+			s.tunnels.Add(1)
+		}
+		s.mu.Unlock()
+		go func() {
+			if draining {
+				defer s.serving.Done()
+			} else {
+				defer s.tunnels.Done()
+			}
+			s.serveStream(logger.WithContext(parent_ctx), logger, session, stream, identity)
+		}()
+	}
+}
+
+// serveStream processes the handshake of a stream, and establishes the tunnel if it succeeds.
+func (s *ServerEndpoint) serveStream(ctx context.Context, logger log.Logger, session quic.Session, stream quic.Stream, identity *token.PeerIdentity) {
+	hsh := tunnel.NewHandshakeHelper(constants.AckMsgLength, func(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
+		return s.handshake(ctx, session, stream, hsh)
+	})
+	hsh.TokenParser = &s.TokenParser
+	hsh.PeerIdentity = identity
+
+	tun := tunnel.NewTunnel(&stream, constants.ServerEndpoint)
+	tun.Hsh = &hsh
+	tun.Hooks = &s.Hooks
+	if !tun.HandShake(ctx) {
+		return
+	}
+	tun.Subject = hsh.Subject
+	tun.Backend = hsh.Backend
+	tun.PeerIdentity = identity
+	tun.ClientAppAddr = hsh.Metadata[tunnel.MetadataClientAppAddr]
+	tun.ForwardRule = hsh.Metadata[tunnel.MetadataForwardRule]
+	// After handshake successful the server application's address is established we can add it to log
+	ctx = logger.WithValues(constants.ServerAppAddr, (*tun.Conn).RemoteAddr().String()).WithContext(ctx)
+	if (*tun.Conn).RemoteAddr().Network() == "udp" {
+		s.establishDatagram(ctx, session, &tun)
+		return
+	}
+	tun.Establish(ctx)
+}
+
+// establishDatagram forwards the datagrams between the UDP server application
+// and the client endpoint, the datagrams are carried by QUIC datagrams.
+func (s *ServerEndpoint) establishDatagram(ctx context.Context, session quic.Session, tun *tunnel.Tunnel) {
+	conn := *tun.Conn
+	defer conn.Close()
+	if !session.ConnectionState().SupportsDatagrams {
+		log.FromContext(ctx).Error("The client endpoint doesn't support QUIC datagram, can't forward UDP traffic.")
+		(*tun.Stream).Close()
+		return
+	}
+	appRecv := make(chan []byte, 128)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			select {
+			case appRecv <- data:
+			default:
+			}
 		}
+	}()
+	appSend := func(data []byte) error {
+		_, err := conn.Write(data)
+		return err
 	}
+	tun.EstablishDatagram(ctx, session, appRecv, appSend, s.UDPIdleTimeout)
 }
 
-func handshake(ctx context.Context, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
+func (s *ServerEndpoint) handshake(ctx context.Context, session quic.Session, stream *quic.Stream, hsh *tunnel.HandshakeHelper) (bool, *net.Conn) {
 	logger := log.FromContext(ctx)
-	logger.Info("Starting handshake with client endpoint")
-	if _, err := io.CopyN(hsh, *stream, constants.TokenLength); err != nil {
+	if err := hsh.ReceiveToken(*stream, s.tokenLength()); err != nil {
 		logger.Errorw("Can not receive token", "error", err.Error())
+		if errors.Is(err, tunnel.ErrUnsupportedVersion) {
+			// Client endpoint is newer, the ack is sent in the latest version
+			hsh.Version = tunnel.HandshakeLatest
+			_ = hsh.SendAck(*stream, constants.UnsupportedHandshake, err.Error())
+		} else if hsh.Version >= tunnel.HandshakeV2 {
+			_ = hsh.SendAck(*stream, constants.ParseTokenError, err.Error())
+		}
+		(*stream).Close()
+		return false, nil
+	}
+	hsh.Capabilities &= s.capabilities(session)
+	// The probes are sent periodically, they aren't logged to avoid flooding the logs.
+	if hsh.Capabilities&tunnel.CapabilityProbe != 0 {
+		s.probe(stream, hsh)
 		return false, nil
 	}
-	addr, err := (*hsh.TokenParser).ParseToken(hsh.ReceiveData)
+	logger.Info("Starting handshake with client endpoint")
+	if addr := hsh.Metadata[tunnel.MetadataClientAppAddr]; addr != "" {
+		logger = logger.WithValues(constants.ClientAppAddr, addr)
+		ctx = logger.WithContext(ctx)
+	}
+	if s.refusing() {
+		logger.Warn("Server endpoint is in maintenance mode or shutting down, refuse the tunnel.")
+		_ = hsh.SendAck(*stream, constants.EndpointDraining, "server endpoint is in maintenance mode or shutting down")
+		(*stream).Close()
+		return false, nil
+	}
+	// The registration of a reverse forward rule doesn't establish a tunnel.
+	if strings.HasPrefix(hsh.ReceiveData, constants.ReverseTokenPrefix) {
+		s.register(ctx, session, stream, hsh)
+		return false, nil
+	}
+	// The parsing, e.g. the command of the Exec parser, is aborted once the session is closed.
+	claims, err := token.ParseTokenContext(session.Context(), *hsh.TokenParser, hsh.ReceiveData, hsh.PeerIdentity)
 	if err != nil {
 		logger.Errorw("Failed to parse token", "error", err.Error())
-		hsh.SetSendData([]byte{constants.ParseTokenError})
-		_, _ = io.Copy(*stream, hsh)
+		_ = hsh.SendAck(*stream, constants.ParseTokenError, "failed to parse token: "+err.Error())
+		return false, nil
+	}
+	hsh.Subject = claims.Subject
+	logger = logger.WithValues(constants.ServerAppAddr, claims.Target)
+	if claims.Subject != "" {
+		logger = logger.WithValues(constants.Subject, claims.Subject)
+	}
+	// The token may resolve to a backend group, all backends of the group must be permitted.
+	backends := parseBackendGroup(claims.Target)
+	if len(backends) == 0 {
+		logger.Error("The server application parsed from the token is empty")
+		_ = hsh.SendAck(*stream, constants.ParseTokenError, "the server application parsed from the token is empty")
+		return false, nil
+	}
+	if s.IdentityMap != nil {
+		for _, backend := range backends {
+			if !s.IdentityMap.Permitted(hsh.PeerIdentity.Identities(), backend) {
+				logger.Warnw("The server application isn't permitted for the client endpoint's identity by the identity map", constants.Backend, backend)
+				_ = hsh.SendAck(*stream, constants.DeniedByPolicy,
+					fmt.Sprintf("the identity %q isn't permitted to connect %s", hsh.PeerIdentity.String(), backend))
+				return false, nil
+			}
+		}
+	}
+	// The hostnames are resolved by the policy, the resolved IPs are dialed. The
+	// backends which fail to resolve are skipped, as if they fail to dial.
+	addrs := make(map[string]string, len(backends))
+	resolveErrs := map[string]error{}
+	for _, backend := range backends {
+		addrs[backend] = backend
+		if s.Policy == nil {
+			continue
+		}
+		addr, err := s.Policy.Resolve(ctx, backend, hsh.PeerIdentity.Identities())
+		if errors.Is(err, policy.ErrDenied) {
+			logger.Warnw("The server application is denied by the access control policy", constants.Backend, backend, "error", err.Error())
+			_ = hsh.SendAck(*stream, constants.DeniedByPolicy, err.Error())
+			return false, nil
+		}
+		if err != nil {
+			resolveErrs[backend] = fmt.Errorf("failed to resolve: %w", err)
+		}
+		addrs[backend] = addr
+	}
+	// The unhealthy backends are skipped, if all are unhealthy, the tunnel fails
+	// fast instead of waiting for the dials to time out.
+	var healthy []string
+	for _, backend := range backends {
+		if s.health.healthy(backend) {
+			healthy = append(healthy, backend)
+		}
+	}
+	if len(healthy) == 0 {
+		logger.Warn("All backends of the server application are unhealthy")
+		_ = hsh.SendAck(*stream, constants.BackendUnhealthy, "all backends of the server application are unhealthy")
 		return false, nil
 	}
-	logger = logger.WithValues(constants.ServerAppAddr, addr)
 	logger.Info("starting connect to server app")
-	sockets := strings.Split(addr, ":")
-	conn, err := net.Dial(strings.ToLower(sockets[0]), strings.Join(sockets[1:], ":"))
-	if err != nil {
-		logger.Errorw("Failed to dial server app", "error", err.Error())
-		hsh.SetSendData([]byte{constants.CannotConnServer})
-		_, _ = io.Copy(*stream, hsh)
+	var conn net.Conn
+	var dialErrs []string
+	for _, backend := range s.backends.order(claims.Target, healthy, hsh.Metadata[tunnel.MetadataClientAppAddr]) {
+		err := resolveErrs[backend]
+		if err == nil {
+			// The backend is counted by least-connections while it is dialed
+			done := s.backends.startDial(backend)
+			conn, err = s.dialBackend(addrs[backend])
+			done()
+		}
+		if err == nil {
+			hsh.Backend = backend
+			break
+		}
+		logger.Errorw("Failed to dial server app", constants.Backend, backend, "error", err.Error())
+		dialErrs = append(dialErrs, backend+": "+err.Error())
+	}
+	if conn == nil {
+		_ = hsh.SendAck(*stream, constants.CannotConnServer, "failed to connect server application: "+strings.Join(dialErrs, "; "))
 		return false, nil
 	}
-	logger.Info("Server app connect successful")
-	hsh.SetSendData([]byte{constants.HandshakeSuccess})
-	if _, err = io.CopyN(*stream, hsh, constants.AckMsgLength); err != nil {
-		logger.Errorw("Faied to send ack info", "error", err.Error(), "", hsh.SendData)
+	logger.Infow("Server app connect successful", constants.Backend, hsh.Backend)
+	if err = hsh.SendAck(*stream, constants.HandshakeSuccess, ""); err != nil {
+		logger.Errorw("Faied to send ack info", "error", err.Error())
+		conn.Close()
 		return false, nil
 	}
 	logger.Info("Handshake successful")
 	return true, &conn
 }
+
+// dialBackend connects the server application with the dial timeout, the socket
+// is like tcp:10.0.0.1:22 or unix:/run/app.sock.
+func (s *ServerEndpoint) dialBackend(socket string) (net.Conn, error) {
+	scheme, addr, _ := strings.Cut(socket, ":")
+	return net.DialTimeout(strings.ToLower(scheme), addr, s.BackendDialTimeout)
+}
+
+// probe acks the health probe of client endpoint, the endpoint isn't healthy
+// if it is in maintenance mode or shutting down, so that client endpoint fails
+// over the new tunnels to the other server endpoints.
+func (s *ServerEndpoint) probe(stream *quic.Stream, hsh *tunnel.HandshakeHelper) {
+	if s.refusing() {
+		_ = hsh.SendAck(*stream, constants.EndpointDraining, "server endpoint is in maintenance mode or shutting down")
+	} else {
+		_ = hsh.SendAck(*stream, constants.HandshakeSuccess, "")
+	}
+	(*stream).Close()
+}
+
+// capabilities returns the capabilities which server endpoint supports over the session.
+func (s *ServerEndpoint) capabilities(session quic.Session) uint32 {
+	caps := tunnel.CapabilityProbe
+	if session.ConnectionState().SupportsDatagrams {
+		caps |= tunnel.CapabilityDatagram
+	}
+	if s.AllowReverse {
+		caps |= tunnel.CapabilityReverse
+	}
+	return caps
+}
+
+// peerIdentity returns the identity of the client endpoint's certificate, it is
+// nil if the client endpoint didn't present a certificate. Only the verified
+// certificate is trusted, otherwise anyone can claim any identity.
+func peerIdentity(session quic.Session) *token.PeerIdentity {
+	chains := session.ConnectionState().TLS.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return token.NewPeerIdentity(chains[0][0])
+}